@@ -3,146 +3,422 @@ package vsphereimages
 import (
 	"context"
 	"net/url"
+	"path"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/progress"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// BackupOptions limit how long the steps of creating or restoring a backup may
+// take. A step that takes longer is cancelled, the steps that were already
+// completed are undone, and a *TimeoutError is returned. A timeout of 0 means
+// no limit.
+type BackupOptions struct {
+	// CloneTimeout limits how long cloning the image or the backup may take.
+	CloneTimeout time.Duration
+}
+
 // RestoreBackup clones a backed up VM image into its original location within the same datacenter.
 //
 // The VM will be cloned initialially with its name suffixed with "-restoring" in the destination folder.
 // Once the clone is complete, the cloned VM will receive a new base snapshot.
 // If there is an existing VM at the destination path, it will be renamed with a "-old" suffix.
 // Finally, the restored VM will be renamed to match its original name.
-func RestoreBackup(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, sourceImagePath string, destinationFolderPath string, defaultDatastorePath string, defaultResourcePool string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
-
-	finder := find.NewFinder(client.Client, false)
+//
+// If any of these steps fail, the steps that were already completed are undone
+// in reverse order: the existing VM is renamed back and the "-restoring" VM is
+// destroyed. The returned error is then a *RollbackError, which lists what was
+// and wasn't undone.
+//
+// If an earlier restore was interrupted, RestoreBackup resumes it: a
+// "-restoring" VM that was cloned from the same backup is used instead of
+// cloning the backup again. If forceClean is true, a leftover "-restoring" VM
+// is destroyed instead, and so is a "-old" VM that is in the way of renaming
+// the existing VM. Without forceClean, these are reported as errors. If the
+// existing VM was already restored from this backup, the restore is done
+// already, and nothing is changed, even with forceClean.
+//
+// The restored VM records the inventory path of the backup it was restored
+// from, so that PruneBackups never destroys that backup.
+//
+// The clone is cancelled and rolled back if it takes longer than
+// options.CloneTimeout.
+func RestoreBackup(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, sourceImagePath string, destinationFolderPath string, defaultDatastorePath string, defaultResourcePool string, forceClean bool, options BackupOptions, s progress.Sinker) error {
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.RestoreBackup(ctx, sourceImagePath, destinationFolderPath, defaultDatastorePath, defaultResourcePool, forceClean, options, s)
+	})
+}
 
-	sourceImage, err := finder.VirtualMachine(ctx, sourceImagePath)
+// RestoreBackup clones a backed up VM image into its original location within
+// the same datacenter. See the RestoreBackup function for details.
+func (c *Client) RestoreBackup(ctx context.Context, sourceImagePath string, destinationFolderPath string, defaultDatastorePath string, defaultResourcePool string, forceClean bool, options BackupOptions, s progress.Sinker) error {
+	sourceImage, err := c.finder.VirtualMachine(ctx, sourceImagePath)
 	if err != nil {
 		return errors.Wrap(err, "finding the backup VM failed")
 	}
 	name := sourceImage.Name()
+	if image, _, ok := parseBackupName(name); ok {
+		// backups made by CreateBackup are named after the image they were
+		// taken of, plus a timestamp
+		name = image
+	}
 
-	destFolder, err := finder.Folder(ctx, destinationFolderPath)
+	destFolder, err := c.finder.Folder(ctx, destinationFolderPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the destination folder failed")
 	}
 
-	var datastore *object.Datastore
-	var pool *object.ResourcePool
-
 	existingImagePath := destFolder.InventoryPath + "/" + name
-	existingImage, err := finder.VirtualMachine(ctx, existingImagePath)
+	oldImagePath := existingImagePath + oldImageSuffix
+	restoringName := name + "-restoring"
+	restoringImagePath := destFolder.InventoryPath + "/" + restoringName
 
-	if err == nil {
-		datastore, err = imageDatastore(ctx, existingImage)
+	existingImage, err := c.findImageIfExists(ctx, existingImagePath)
+	if err != nil {
+		return errors.Wrap(err, "finding the existing VM failed")
+	}
+
+	oldImage, err := c.findImageIfExists(ctx, oldImagePath)
+	if err != nil {
+		return errors.Wrap(err, "finding the old VM failed")
+	}
+
+	restoringImage, err := c.findImageIfExists(ctx, restoringImagePath)
+	if err != nil {
+		return errors.Wrap(err, "finding a leftover restoring VM failed")
+	}
+
+	if existingImage != nil {
+		restoredFrom, err := imageRestoredFrom(ctx, existingImage)
 		if err != nil {
-			return errors.Wrap(err, "finding the existing datastore failed")
+			return errors.Wrap(err, "checking where the existing VM was restored from failed")
 		}
 
-		pool, err = existingImage.ResourcePool(ctx)
+		// the backup has already been restored, e.g. by an earlier run that
+		// was retried after it succeeded, so there is nothing to do, and
+		// nothing to clean up either
+		if restoredFrom == sourceImage.InventoryPath {
+			return nil
+		}
+	}
+
+	if restoringImage != nil && !forceClean {
+		restoredFrom, err := imageRestoredFrom(ctx, restoringImage)
 		if err != nil {
-			return errors.Wrap(err, "finding the existing resource pool failed")
+			return errors.Wrap(err, "checking where the leftover restoring VM was restored from failed")
 		}
-	} else {
-		datastore, err = finder.Datastore(ctx, defaultDatastorePath)
+
+		if restoredFrom != sourceImage.InventoryPath {
+			return errors.Errorf("%s is left over from restoring a different backup, remove it or force a clean restore", restoringImagePath)
+		}
+	}
+
+	if forceClean {
+		if restoringImage != nil {
+			if err = c.destroyImage(ctx, restoringImagePath); err != nil {
+				return errors.Wrap(err, "destroying the leftover restoring VM failed")
+			}
+			restoringImage = nil
+		}
+
+		// without an existing VM, the old VM is the only copy of the image
+		// that was there before, so it is only destroyed if it's in the way
+		if existingImage != nil && oldImage != nil {
+			if err = c.destroyImage(ctx, oldImagePath); err != nil {
+				return errors.Wrap(err, "destroying the old VM failed")
+			}
+			oldImage = nil
+		}
+	}
+
+	if existingImage != nil && oldImage != nil {
+		return &AlreadyExistsError{Path: oldImagePath, Hint: "remove it or force a clean restore"}
+	}
+
+	steps := 3
+	if restoringImage == nil {
+		steps++
+	}
+	if existingImage != nil {
+		steps++
+	}
+	s = withSteps(s, steps)
+
+	var t transaction
+
+	if restoringImage == nil {
+		var datastore *object.Datastore
+		var pool *object.ResourcePool
+
+		// if an earlier restore was interrupted after renaming the existing
+		// VM, the old VM is where the restored VM should be placed
+		placementImage := existingImage
+		if placementImage == nil {
+			placementImage = oldImage
+		}
+
+		if placementImage != nil {
+			datastore, err = imageDatastore(ctx, placementImage)
+			if err != nil {
+				return errors.Wrap(err, "finding the existing datastore failed")
+			}
+
+			pool, err = placementImage.ResourcePool(ctx)
+			if err != nil {
+				return errors.Wrap(err, "finding the existing resource pool failed")
+			}
+		} else {
+			datastore, err = c.finder.Datastore(ctx, defaultDatastorePath)
+			if err != nil {
+				return errors.Wrap(err, "finding the datastore failed")
+			}
+
+			pool, err = c.finder.ResourcePool(ctx, defaultResourcePool)
+			if err != nil {
+				return errors.Wrap(err, "finding the resource pool failed")
+			}
+		}
+		datastoreRef := datastore.Reference()
+		poolRef := pool.Reference()
+
+		cloneSpec := types.VirtualMachineCloneSpec{
+			Location: types.VirtualMachineRelocateSpec{
+				Datastore: &datastoreRef,
+				Pool:      &poolRef,
+			},
+			// record where the image came from, so that PruneBackups doesn't
+			// destroy this backup
+			Config: &types.VirtualMachineConfigSpec{
+				ExtraConfig: []types.BaseOptionValue{
+					&types.OptionValue{Key: restoredFromKey, Value: sourceImage.InventoryPath},
+				},
+			},
+		}
+
+		nextStep(s, "cloning the backup to "+restoringName)
+		// a failed clone may still leave a half-made VM behind, so this is
+		// recorded once the clone has started
+		recorded := false
+		err = c.runTask(ctx, Action{Step: "cloning the backup to " + restoringName, Method: "CloneVM_Task", Object: sourceImage.InventoryPath, Target: restoringImagePath}, s, func(s progress.Sinker) error {
+			task, err := sourceImage.Clone(ctx, destFolder, restoringName, cloneSpec)
+			if err != nil {
+				return errors.Wrap(err, "creating VM clone task failed")
+			}
+
+			if !recorded {
+				t.done("cloning "+restoringName, func(ctx context.Context) error {
+					return c.destroyImage(ctx, restoringImagePath)
+				})
+				recorded = true
+			}
+
+			_, err = waitForStep(ctx, task, "cloning the backup to "+restoringName, options.CloneTimeout, s)
+			return errors.Wrap(err, "cloning VM failed")
+		})
 		if err != nil {
-			return errors.Wrap(err, "finding the datastore failed")
+			return t.rollback(ctx, err)
 		}
 
-		pool, err = finder.ResourcePool(ctx, defaultResourcePool)
+		restoringImage, err = c.findCreatedImage(ctx, restoringImagePath)
 		if err != nil {
-			return errors.Wrap(err, "finding the resource pool failed")
+			return t.rollback(ctx, errors.Wrap(err, "finding the restoring VM failed"))
+		}
+	}
+
+	if err = c.resnapshotImage(ctx, restoringImage, s); err != nil {
+		return t.rollback(ctx, err) // this error is already distinct enough
+	}
+
+	if existingImage != nil {
+		nextStep(s, "renaming "+name+" to "+name+oldImageSuffix)
+		if err = c.renameImage(ctx, existingImage, name+oldImageSuffix, s); err != nil {
+			return t.rollback(ctx, errors.Wrap(err, "renaming existing VM failed"))
 		}
+
+		t.done("renaming "+name+" to "+name+oldImageSuffix, func(ctx context.Context) error {
+			return c.renameImage(ctx, existingImage, name, nil)
+		})
+	}
+
+	nextStep(s, "renaming "+restoringName+" to "+name)
+	if err = c.renameImage(ctx, restoringImage, name, s); err != nil {
+		return t.rollback(ctx, errors.Wrap(err, "renaming restoring VM failed"))
+	}
+
+	return nil
+}
+
+// backupTimestampLayout is the layout of the timestamp that CreateBackup
+// appends to the names of backups.
+const backupTimestampLayout = "20060102-150405"
+
+// CreateBackup clones an image into a backup folder within the same datacenter.
+//
+// The backup is named after the image, suffixed with the UTC time at which the
+// backup was taken (e.g. "foo-20170102-150405"). If the image has a "base"
+// snapshot, the backup is cloned from that snapshot, since that is what builds
+// are cloned from. The backup is stored on the datastore at datastorePath, or
+// on the image's own datastore if datastorePath is empty.
+// Once the clone is complete, the backup receives a new base snapshot.
+//
+// If any of these steps fail, the half-made backup is destroyed. The clone is
+// cancelled if it takes longer than options.CloneTimeout.
+//
+// The inventory path of the backup is returned.
+func CreateBackup(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imagePath string, backupFolderPath string, datastorePath string, options BackupOptions, s progress.Sinker) (string, error) {
+	var backupPath string
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		backupPath, err = c.CreateBackup(ctx, imagePath, backupFolderPath, datastorePath, options, s)
+		return err
+	})
+	return backupPath, err
+}
+
+// CreateBackup clones an image into a backup folder within the same
+// datacenter. See the CreateBackup function for details.
+func (c *Client) CreateBackup(ctx context.Context, imagePath string, backupFolderPath string, datastorePath string, options BackupOptions, s progress.Sinker) (string, error) {
+	image, err := c.finder.VirtualMachine(ctx, imagePath)
+	if err != nil {
+		return "", errors.Wrap(err, "finding the VM failed")
+	}
+
+	backupFolder, err := c.finder.Folder(ctx, backupFolderPath)
+	if err != nil {
+		return "", errors.Wrap(err, "finding the backup folder failed")
+	}
+
+	var datastore *object.Datastore
+	if datastorePath == "" {
+		datastore, err = imageDatastore(ctx, image)
+	} else {
+		datastore, err = c.finder.Datastore(ctx, datastorePath)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "finding the datastore failed")
 	}
 	datastoreRef := datastore.Reference()
-	poolRef := pool.Reference()
 
 	cloneSpec := types.VirtualMachineCloneSpec{
 		Location: types.VirtualMachineRelocateSpec{
 			Datastore: &datastoreRef,
-			Pool:      &poolRef,
 		},
 	}
 
-	restoringName := name + "-restoring"
-	task, err := sourceImage.Clone(ctx, destFolder, restoringName, cloneSpec)
-	if err != nil {
-		return errors.Wrap(err, "creating VM clone task failed")
+	// a clone of the VM itself would have the VM's current state, which may
+	// have changed since the base snapshot was taken
+	if snapshotRef, err := image.FindSnapshot(ctx, "base"); err == nil {
+		cloneSpec.Snapshot = snapshotRef
 	}
 
-	if _, err = task.WaitForResult(ctx, s); err != nil {
+	s = withSteps(s, 3)
+
+	name := backupName(image.Name(), time.Now())
+	nextStep(s, "cloning the image to "+name)
+	// a failed clone may still leave a half-made backup behind, so this is
+	// recorded once the clone has started
+	var t transaction
+	backupPath := backupFolder.InventoryPath + "/" + name
+	recorded := false
+	err = c.runTask(ctx, Action{Step: "cloning the image to " + name, Method: "CloneVM_Task", Object: image.InventoryPath, Target: backupPath}, s, func(s progress.Sinker) error {
+		task, err := image.Clone(ctx, backupFolder, name, cloneSpec)
+		if err != nil {
+			return errors.Wrap(err, "creating VM clone task failed")
+		}
+
+		if !recorded {
+			t.done("cloning "+name, func(ctx context.Context) error {
+				return c.destroyImage(ctx, backupPath)
+			})
+			recorded = true
+		}
+
+		_, err = waitForStep(ctx, task, "cloning the image to "+name, options.CloneTimeout, s)
 		return errors.Wrap(err, "cloning VM failed")
+	})
+	if err != nil {
+		return "", t.rollback(ctx, err)
 	}
 
-	restoringImage, err := finder.VirtualMachine(ctx, destinationFolderPath+"/"+restoringName)
+	backup, err := c.findCreatedImage(ctx, backupPath)
 	if err != nil {
-		return errors.Wrap(err, "finding the restoring VM failed")
+		return "", t.rollback(ctx, errors.Wrap(err, "finding the backup VM failed"))
 	}
 
-	if err = resnapshotImage(ctx, restoringImage, s); err != nil {
-		return err // this error is already distinct enough
+	if err = c.resnapshotImage(ctx, backup, s); err != nil {
+		return "", t.rollback(ctx, err)
 	}
 
-	if existingImage != nil {
-		if err = renameImage(ctx, existingImage, name+"-old", s); err != nil {
-			return errors.Wrap(err, "renaming existing VM failed")
-		}
+	if planFrom(ctx) != nil {
+		return backupPath, nil
 	}
 
-	if err = renameImage(ctx, restoringImage, name, s); err != nil {
-		return errors.Wrap(err, "renaming restoring VM failed")
+	if _, err = backup.FindSnapshot(ctx, "base"); err != nil {
+		return "", t.rollback(ctx, errors.Wrap(err, "verifying the backup VM's base snapshot failed"))
 	}
 
-	return nil
+	return backupPath, nil
 }
 
-func resnapshotImage(ctx context.Context, vm *object.VirtualMachine, s progress.Sinker) error {
-	task, err := vm.RemoveAllSnapshot(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "creating remove snapshot task failed")
-	}
+// backupName returns the name of a backup of the image called name, taken at t.
+func backupName(name string, t time.Time) string {
+	return name + "-" + t.UTC().Format(backupTimestampLayout)
+}
 
-	if _, err = task.WaitForResult(ctx, s); err != nil {
-		return errors.Wrap(err, "removing all snapshots failed")
-	}
+// resnapshotImage replaces all of the VM's snapshots with a new base snapshot.
+// This is two steps, which are reported to s if it came from withSteps.
+func (c *Client) resnapshotImage(ctx context.Context, vm *object.VirtualMachine, s progress.Sinker) error {
+	nextStep(s, "removing snapshots")
+	err := c.runTask(ctx, Action{Step: "removing snapshots", Method: "RemoveAllSnapshots_Task", Object: vm.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := vm.RemoveAllSnapshot(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "creating remove snapshot task failed")
+		}
 
-	task, err = vm.CreateSnapshot(ctx, "base", "", false, false)
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "removing all snapshots failed")
+	})
 	if err != nil {
-		return errors.Wrap(err, "creating task to create snapshot failed")
+		return err
 	}
 
-	if _, err = task.WaitForResult(ctx, s); err != nil {
-		return errors.Wrap(err, "creating snapshot failed")
-	}
+	nextStep(s, "creating the base snapshot")
+	return c.runTask(ctx, Action{Step: "creating the base snapshot", Method: "CreateSnapshot_Task", Object: vm.InventoryPath, Target: "base"}, s, func(s progress.Sinker) error {
+		task, err := vm.CreateSnapshot(ctx, "base", "", false, false)
+		if err != nil {
+			return errors.Wrap(err, "creating task to create snapshot failed")
+		}
 
-	return nil
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "creating snapshot failed")
+	})
 }
 
-func renameImage(ctx context.Context, vm *object.VirtualMachine, newName string, s progress.Sinker) error {
+func (c *Client) renameImage(ctx context.Context, vm *object.VirtualMachine, newName string, s progress.Sinker) error {
 	configSpec := types.VirtualMachineConfigSpec{
 		Name: newName,
 	}
 
-	task, err := vm.Reconfigure(ctx, configSpec)
-	if err != nil {
-		return errors.Wrap(err, "creating VM rename task failed")
-	}
+	newPath := path.Join(path.Dir(vm.InventoryPath), newName)
+	err := c.runTask(ctx, Action{Step: "renaming the VM to " + newName, Method: "Reconfigure_Task", Object: vm.InventoryPath, Target: newPath}, s, func(s progress.Sinker) error {
+		task, err := vm.Reconfigure(ctx, configSpec)
+		if err != nil {
+			return errors.Wrap(err, "creating VM rename task failed")
+		}
 
-	if _, err = task.WaitForResult(ctx, s); err != nil {
+		_, err = waitForTask(ctx, task, s)
 		return errors.Wrap(err, "renaming VM failed")
+	})
+	if err != nil {
+		return err
 	}
 
+	// later steps, and the actions of a plan, refer to the VM by its new name
+	vm.InventoryPath = newPath
 	return nil
 }
 
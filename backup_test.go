@@ -0,0 +1,404 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestCreateBackup(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := CreateBackup(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(backupPath, "/DC0/vm/backups/DC0_H0_VM0-") {
+		t.Fatalf("unexpected backup path %s", backupPath)
+	}
+
+	if err = hasBaseSnapshot(ctx, service, backupPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateBackupIntoNonexistentFolder(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	logger := newProgressLogger()
+	defer logger.Wait()
+	_, err = CreateBackup(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err == nil {
+		t.Fatal("expected error creating backup, but none occurred")
+	}
+	if !strings.Contains(err.Error(), "finding the backup folder failed") {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Reference() == existing.Reference() {
+		t.Fatal("expected the restored VM to replace the existing VM")
+	}
+
+	old, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Reference() != existing.Reference() {
+		t.Fatal("expected the existing VM to be renamed with a -old suffix")
+	}
+
+	if err = hasBaseSnapshot(ctx, service, "/DC0/vm/DC0_H0_VM0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreBackupTwice(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the simulator doesn't apply the config of a clone spec
+	if err = setRestoredFrom(ctx, restored, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+	again, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Reference() != restored.Reference() {
+		t.Fatal("expected restoring the same backup again to leave the restored VM in place")
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", true, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old"); err != nil {
+		t.Fatalf("expected a clean restore of the same backup to keep the old VM, got %v", err)
+	}
+
+	otherBackupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, otherBackupPath, "/DC0/vm/backups", "DC0_H0_VM0-20170102-150405", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RestoreBackup(ctx, "/DC0/vm/backups/DC0_H0_VM0-20170102-150405", "/DC0/vm", "", "", false, BackupOptions{}, logger)
+	if err == nil {
+		t.Fatal("expected error restoring a different backup, but none occurred")
+	}
+	if !strings.Contains(err.Error(), "DC0_H0_VM0-old already exists") {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreBackupTwiceIntoEmptyFolder(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+	if err = createFolder(ctx, service, "/DC0/vm", "restored"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm/restored", "/DC0/datastore/LocalDS_0", "/DC0/host/DC0_C0/Resources", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := client.finder.VirtualMachine(ctx, "/DC0/vm/restored/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the simulator doesn't apply the config of a clone spec
+	if err = setRestoredFrom(ctx, restored, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm/restored", "/DC0/datastore/LocalDS_0", "/DC0/host/DC0_C0/Resources", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+	again, err := client.finder.VirtualMachine(ctx, "/DC0/vm/restored/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Reference() != restored.Reference() {
+		t.Fatal("expected restoring the same backup again to leave the restored VM in place")
+	}
+	if vm, err := client.findImageIfExists(ctx, "/DC0/vm/restored/DC0_H0_VM0-old"); err != nil || vm != nil {
+		t.Fatalf("expected the restored VM not to be renamed, got %v, %v", vm, err)
+	}
+}
+
+func TestRestoreBackupResumesInterruptedRestore(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend an earlier restore was interrupted after cloning the backup
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-restoring", logger); err != nil {
+		t.Fatal(err)
+	}
+	leftover, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-restoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setRestoredFrom(ctx, leftover, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Reference() != leftover.Reference() {
+		t.Fatal("expected the leftover restoring VM to be used")
+	}
+}
+
+func TestRestoreBackupWithLeftoverFromDifferentBackup(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-restoring", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger)
+	if err == nil {
+		t.Fatal("expected error restoring backup, but none occurred")
+	}
+	if !strings.Contains(err.Error(), "left over from restoring a different backup") {
+		t.Fatal(err)
+	}
+
+	if err = powerOff(ctx, client, "/DC0/vm/DC0_H0_VM0-restoring"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", true, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreBackupWithOldImageInTheWay(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-old", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, logger)
+	if err == nil {
+		t.Fatal("expected error restoring backup, but none occurred")
+	}
+	if !strings.Contains(err.Error(), "DC0_H0_VM0-old already exists") {
+		t.Fatal(err)
+	}
+
+	if err = powerOff(ctx, client, "/DC0/vm/DC0_H0_VM0-old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", true, BackupOptions{}, logger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setRestoredFrom(ctx context.Context, vm *object.VirtualMachine, backupPath string) error {
+	task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: restoredFromKey, Value: backupPath},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return task.Wait(ctx)
+}
+
+func powerOff(ctx context.Context, client *Client, vmPath string) error {
+	vm, err := client.finder.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		return err
+	}
+
+	task, err := vm.PowerOff(ctx)
+	if err != nil {
+		return err
+	}
+
+	return task.Wait(ctx)
+}
@@ -0,0 +1,222 @@
+package vsphereimages
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// keepAliveInterval is how long a session may be idle before the client sends
+// a request to keep it from expiring. vCenter expires idle sessions after 30
+// minutes by default.
+const keepAliveInterval = 5 * time.Minute
+
+// Client is a vSphere API client that owns a single authenticated session.
+//
+// The session is kept alive in the background while the client is idle, and
+// is logged in again if vCenter reports that it is no longer authenticated.
+// Callers should call Logout once they are done with the client, so that the
+// session doesn't linger on vCenter until it expires.
+type Client struct {
+	// RetryPolicy says how the steps run by the client are retried if they
+	// fail because of a transient fault. It starts out as
+	// DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	endpoint  *url.URL
+	tlsConfig *tls.Config
+	client    *govmomi.Client
+	finder    *find.Finder
+
+	// loginMutex serializes logging in again, loginCount counts the times
+	// the client has logged in, and loggedOut is set once Logout is called,
+	// after which it isn't logged in again.
+	loginMutex sync.Mutex
+	loginCount int
+	loggedOut  bool
+}
+
+// NewClient connects to the vSphere API at vSphereEndpoint and logs in with
+// the credentials in the URL.
+func NewClient(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool) (*Client, error) {
+	return NewClientWithTLS(ctx, vSphereEndpoint, TLSOptions{InsecureSkipVerify: vSphereInsecureSkipVerify})
+}
+
+// NewClientWithTLS is like NewClient, but verifies the certificate presented
+// by the vSphere API according to tlsOptions.
+func NewClientWithTLS(ctx context.Context, vSphereEndpoint *url.URL, tlsOptions TLSOptions) (*Client, error) {
+	tlsConfig, err := tlsOptions.tlsConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "configuring TLS failed")
+	}
+
+	soapClient := soap.NewClient(vSphereEndpoint, tlsOptions.InsecureSkipVerify)
+	if transport, ok := soapClient.Client.Transport.(*http.Transport); ok {
+		transport.TLSClientConfig = tlsConfig
+	}
+	soapClient.Client.Transport = statusTransport{soapClient.Client.Transport}
+
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to vSphere failed")
+	}
+
+	c := &Client{
+		RetryPolicy: DefaultRetryPolicy,
+		endpoint:    vSphereEndpoint,
+		tlsConfig:   tlsConfig,
+		client: &govmomi.Client{
+			Client:         vimClient,
+			SessionManager: session.NewManager(vimClient),
+		},
+		finder: find.NewFinder(vimClient, false),
+	}
+
+	vimClient.RoundTripper = &reloginHandler{roundTripper: vimClient.RoundTripper, c: c}
+	vimClient.RoundTripper = session.KeepAliveHandler(vimClient.RoundTripper, keepAliveInterval, c.keepAlive)
+
+	if err := c.login(ctx); err != nil {
+		return nil, errors.Wrap(err, "logging in to vSphere failed")
+	}
+
+	return c, nil
+}
+
+// Logout ends the client's session on vCenter. The client shouldn't be used
+// after calling Logout. If ctx is done, such as when the operation the client
+// was used for was cancelled, a new context is used to log out with.
+func (c *Client) Logout(ctx context.Context) error {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	c.loginMutex.Lock()
+	c.loggedOut = true
+	c.loginMutex.Unlock()
+
+	return errors.Wrap(c.client.Logout(ctx), "logging out of vSphere failed")
+}
+
+func (c *Client) login(ctx context.Context) error {
+	if c.endpoint.User == nil {
+		return nil
+	}
+
+	return c.client.Login(ctx, c.endpoint.User)
+}
+
+// relogin logs in again after a request failed with NotAuthenticated, unless
+// another request already did so since loginCount was count. It returns
+// whether the request should be sent again.
+func (c *Client) relogin(ctx context.Context, count int) bool {
+	c.loginMutex.Lock()
+	defer c.loginMutex.Unlock()
+
+	if c.loggedOut {
+		return false
+	}
+	if c.loginCount != count {
+		return true
+	}
+
+	if err := c.login(ctx); err != nil {
+		return false
+	}
+	c.loginCount++
+	return true
+}
+
+// reloginHandler is a soap.RoundTripper that logs in again if a request fails
+// because the session is no longer authenticated, such as after it expired or
+// vpxd restarted, and sends the request once more.
+type reloginHandler struct {
+	roundTripper soap.RoundTripper
+	c            *Client
+}
+
+func (h *reloginHandler) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	switch req.(type) {
+	case *methods.LoginBody, *methods.LogoutBody:
+		return h.roundTripper.RoundTrip(ctx, req, res)
+	}
+
+	h.c.loginMutex.Lock()
+	count := h.c.loginCount
+	h.c.loginMutex.Unlock()
+
+	err := h.roundTripper.RoundTrip(ctx, req, res)
+	if !isNotAuthenticated(err) || !h.c.relogin(ctx, count) {
+		return err
+	}
+
+	// the fault is left in the response otherwise, since only the elements
+	// in the new response are decoded into it
+	reflect.ValueOf(res).Elem().Set(reflect.Zero(reflect.TypeOf(res).Elem()))
+	return h.roundTripper.RoundTrip(ctx, req, res)
+}
+
+// keepAlive is run by the keep-alive handler after the session has been idle
+// for a while. If the session has already expired, the request it sends logs
+// in again.
+//
+// It never returns an error, since the keep-alive handler deadlocks stopping
+// itself on one, which hangs every later Login and Logout. If logging in again
+// failed, the next request tries again.
+func (c *Client) keepAlive(roundTripper soap.RoundTripper) error {
+	_, _ = methods.GetCurrentTime(context.Background(), roundTripper)
+	return nil
+}
+
+func isNotAuthenticated(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+
+	switch soap.ToSoapFault(err).VimFault().(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+
+	return false
+}
+
+// statusTransport is an http.RoundTripper that returns a *StatusError for 503
+// Service Unavailable responses. The SOAP client would only return their
+// status line as the text of an error otherwise.
+type statusTransport struct {
+	http.RoundTripper
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		return res, err
+	}
+
+	res.Body.Close()
+	return nil, &StatusError{StatusCode: res.StatusCode, Status: res.Status}
+}
+
+// withClient creates a client for a one-off operation, passes it to f and
+// logs out again once f returns.
+func withClient(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, f func(*Client) error) error {
+	client, err := NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
+	if err != nil {
+		return errors.Wrap(err, "creating vSphere client failed")
+	}
+	defer client.Logout(ctx)
+
+	return f(client)
+}
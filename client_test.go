@@ -0,0 +1,97 @@
+package vsphereimages
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/methods"
+)
+
+func TestClientChainsOperations(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = client.SnapshotImage(ctx, "/DC0/vm/DC0_H0_VM0", logger); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm", "my_renamed_vm", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	vms, err := client.ListImages(ctx, "/DC0/vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 8 {
+		t.Fatalf("unexpected number of vms, expected 8, got %d", len(vms))
+	}
+
+	if err = client.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLogout(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.ListImages(ctx, "/DC0/vm"); err == nil {
+		t.Fatal("expected error listing images after logging out, but none occurred")
+	}
+}
+
+func TestClientLogsInAgain(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	// end the session behind the client's back, like when it expires
+	if err = session.NewManager(client.client.Client).Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the simulator answers property requests without a session with
+	// missing properties rather than a fault, so another request is sent
+	// first
+	if _, err = methods.GetCurrentTime(ctx, client.client); err != nil {
+		t.Fatalf("expected the request to log in again, got %v", err)
+	}
+
+	if _, err = client.ListImages(ctx, "/DC0/vm"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net/url"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -15,7 +13,7 @@ var checkinHostCommand = cli.Command{
 	Usage:     "Puts the only host in the cluster into maintenance mode",
 	ArgsUsage: "cluster-path",
 	Action:    checkinHostAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -30,7 +28,7 @@ var checkinHostCommand = cli.Command{
 			Name:  "dest-pool",
 			Usage: "Path to cluster where the host will be moved",
 		},
-	},
+	}, append(append(append(vSphereTLSFlags, checkOutTimeoutFlags...), dryRunFlags...), credentialFlags("")...)...),
 }
 
 func checkinHostAction(c *cli.Context) error {
@@ -44,6 +42,11 @@ func checkinHostAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	clusterInventoryPath := c.Args().Get(0)
 	if clusterInventoryPath == "" {
 		return errors.New("cluster inventory path is required")
@@ -54,14 +57,27 @@ func checkinHostAction(c *cli.Context) error {
 		return errors.New("destination cluster path is required")
 	}
 
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Checking in host… ")
-	host, err := vsphereimages.CheckInHost(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), clusterInventoryPath, destinationClusterPath, logger)
+	host, err := client.CheckInHost(ctx, clusterInventoryPath, destinationClusterPath, checkOutOptions(c), logger)
 	if err != nil {
 		return errors.Wrap(err, "checking in host failed")
 	}
 	logger.Wait()
 
+	if plan != nil {
+		return printPlan(c, "Checking in the host in "+clusterInventoryPath, plan)
+	}
+
 	fmt.Println("Checked in host", host.Name())
 
 	return nil
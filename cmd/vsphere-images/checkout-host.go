@@ -1,13 +1,11 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net/url"
 	"os"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -16,7 +14,7 @@ var checkoutHostCommand = cli.Command{
 	Usage:     "Chooses a host from a cluster to bring down to maintenance mode",
 	ArgsUsage: "cluster-path",
 	Action:    checkoutHostAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -32,10 +30,14 @@ var checkoutHostCommand = cli.Command{
 			Usage: "Path to cluster where the host will be moved",
 		},
 		cli.BoolFlag{
-			Name:  "dry-run, n",
+			Name:  "check",
 			Usage: "If enabled, only checks if a host is checked out to the destination cluster",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Deprecated, use --check",
+		},
+	}, append(append(append(vSphereTLSFlags, checkOutTimeoutFlags...), planFlags("plan")...), credentialFlags("")...)...),
 }
 
 func checkoutHostAction(c *cli.Context) error {
@@ -49,17 +51,33 @@ func checkoutHostAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	destinationClusterPath := c.String("dest-pool")
 	if destinationClusterPath == "" {
 		return errors.New("destination cluster path is required")
 	}
 
-	dryRun := c.Bool("dry-run")
+	ctx, plan, err := planContextFor(c, "plan")
+	if err != nil {
+		return err
+	}
 
-	ctx := context.Background()
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 
-	if dryRun {
-		checkedOut, err := vsphereimages.IsHostCheckedOut(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), destinationClusterPath)
+	if c.Bool("dry-run") {
+		fmt.Fprintln(os.Stderr, "warning: --dry-run is deprecated for checkout-host and will be removed, use --check instead (or --plan to print what checking out a host would do)")
+	}
+
+	if c.Bool("check") || c.Bool("dry-run") {
+		checkedOut, err := client.IsHostCheckedOut(ctx, destinationClusterPath)
 		if err != nil {
 			return errors.Wrap(err, "finding checked out host failed")
 		}
@@ -68,8 +86,9 @@ func checkoutHostAction(c *cli.Context) error {
 			return nil
 		}
 
-		// report a non-zero exit code to indicate there is no checked out host
-		os.Exit(1)
+		// report a non-zero exit code, without a message, to indicate there
+		// is no checked out host
+		return cli.NewExitError("", exitNotCheckedOut)
 	} else {
 		clusterInventoryPath := c.Args().Get(0)
 		if clusterInventoryPath == "" {
@@ -77,17 +96,17 @@ func checkoutHostAction(c *cli.Context) error {
 		}
 
 		logger := newProgressLogger("Checking out host… ")
-		host, err := vsphereimages.CheckOutHost(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), clusterInventoryPath, destinationClusterPath, logger)
+		host, err := client.CheckOutHost(ctx, clusterInventoryPath, destinationClusterPath, checkOutOptions(c), logger)
 		if err != nil {
 			return errors.Wrap(err, "checking out host failed")
 		}
 		logger.Wait()
 
-		if host == nil {
-			fmt.Println("No suitable host to check out was found")
-		} else {
-			fmt.Println("Checked out host", host.Name())
+		if plan != nil {
+			return printPlan(c, "Checking out a host from "+clusterInventoryPath+" to "+destinationClusterPath, plan)
 		}
+
+		fmt.Println("Checked out host", host.Name())
 	}
 
 	return nil
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"net/url"
 
 	"github.com/pkg/errors"
@@ -15,7 +14,7 @@ var configureImageCommand = cli.Command{
 	Usage:     "Reconfigures properties of a virtual machine",
 	ArgsUsage: "image-inventory-path",
 	Action:    configureImageAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -42,7 +41,11 @@ var configureImageCommand = cli.Command{
 			Name:  "network",
 			Usage: "The name of the network to use",
 		},
-	},
+		cli.StringFlag{
+			Name:  "network-map",
+			Usage: "Which network to connect each NIC to, as a comma-separated list of nic-or-network=network-path, e.g. ethernet-0=/dc/network/a,ethernet-1=/dc/network/b. Every NIC must be mapped.",
+		},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func configureImageAction(c *cli.Context) error {
@@ -56,6 +59,11 @@ func configureImageAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	imagePath := c.Args().Get(0)
 	if imagePath == "" {
 		return errors.New("image inventory path is required")
@@ -80,13 +88,34 @@ func configureImageAction(c *cli.Context) error {
 
 	network := c.String("network")
 
-	ctx := context.Background()
+	networks, err := vsphereimages.ParseNetworkMapping(c.String("network-map"))
+	if err != nil {
+		return err
+	}
+	if network != "" && len(networks) > 0 {
+		return errors.New("only one of the 'network' and 'network-map' flags can be given")
+	}
+
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Configuring image… ")
-	err = vsphereimages.ConfigureImage(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), imagePath, configSpec, network, logger)
+	if len(networks) > 0 {
+		err = client.ConfigureImageNetworks(ctx, imagePath, configSpec, networks, logger)
+	} else {
+		err = client.ConfigureImage(ctx, imagePath, configSpec, network, logger)
+	}
 	if err != nil {
 		return errors.Wrap(err, "configuring image failed")
 	}
 	logger.Wait()
 
-	return nil
+	return printPlan(c, "Configuring "+imagePath, plan)
 }
@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/pkg/errors"
 	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
+	"github.com/vmware/govmomi/vim25/progress"
 )
 
 var copyImageCommand = cli.Command{
 	Name:      "copy-image",
 	Usage:     "copy image from one vCenter to another",
-	ArgsUsage: "src-image-name dest-image-name",
+	ArgsUsage: "src-image-name dest-image-name [dest-image-name...]",
 	Action:    copyImageAction,
-	Flags: []cli.Flag{
+	Flags: append(append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "src-profile",
+			Usage:  "The name of the profile in the config file to use for the source vCenter",
+			EnvVar: "VSPHERE_IMAGES_SRC_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "dest-profile",
+			Usage:  "The name of the profile in the config file to use for the destination vCenter",
+			EnvVar: "VSPHERE_IMAGES_DEST_PROFILE",
+		},
 		cli.StringFlag{
 			Name:   "src-url",
 			Usage:  "URL to the source vCenter",
@@ -36,9 +50,29 @@ var copyImageCommand = cli.Command{
 			Usage:  "Whether the destination vCenter's certificate chain and hostname should be verified",
 			EnvVar: "VSPHERE_IMAGES_DEST_INSECURE_SKIP_VERIFY",
 		},
+		cli.StringFlag{
+			Name:   "src-ca-file",
+			Usage:  "A PEM file with the CA certificates to trust for the source vCenter, instead of the system's",
+			EnvVar: "VSPHERE_IMAGES_SRC_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "dest-ca-file",
+			Usage:  "A PEM file with the CA certificates to trust for the destination vCenter, instead of the system's",
+			EnvVar: "VSPHERE_IMAGES_DEST_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "src-sha256-fingerprint",
+			Usage:  "Only accept a certificate with this SHA-256 fingerprint from the source vCenter. Format should be :-separated hexadecimal numbers.",
+			EnvVar: "VSPHERE_IMAGES_SRC_SHA256_FINGERPRINT",
+		},
+		cli.StringFlag{
+			Name:   "dest-sha256-fingerprint",
+			Usage:  "Only accept a certificate with this SHA-256 fingerprint from the destination vCenter. Format should be :-separated hexadecimal numbers.",
+			EnvVar: "VSPHERE_IMAGES_DEST_SHA256_FINGERPRINT",
+		},
 		cli.StringFlag{
 			Name:   "dest-sha1-fingerprint",
-			Usage:  "The SHA-1 fingerprint of the TLS certificate on the destination vCenter. Format should be :-separated hexadecimal numbers. Leave empty in order to compute the fingerprint on this machine.",
+			Usage:  "The SHA-1 fingerprint of the TLS certificate on the destination vCenter. Format should be :-separated hexadecimal numbers. Leave empty in order to compute the fingerprint on this machine. If given, it must match the certificate the destination vCenter presents.",
 			EnvVar: "VSPHERE_IMAGES_DEST_SHA1_FINGERPRINT",
 		},
 		cli.StringFlag{
@@ -56,12 +90,48 @@ var copyImageCommand = cli.Command{
 			Usage:  "The inventory path to the host to put the VM in in the destination vCenter",
 			EnvVar: "VSPHERE_IMAGES_DEST_HOST_PATH",
 		},
+		cli.StringFlag{
+			Name:   "dest-folder-path",
+			Usage:  "The inventory path to the folder in the destination vCenter to put the VM in, for destination image names that aren't inventory paths",
+			EnvVar: "VSPHERE_IMAGES_DEST_FOLDER_PATH",
+		},
 		cli.StringFlag{
 			Name:   "dest-network-name",
 			Usage:  "The name of the network to connect the copied VM to.",
 			EnvVar: "VSPHERE_IMAGES_DEST_NETWORK_NAME",
 		},
-	},
+		cli.StringFlag{
+			Name:   "dest-network-map",
+			Usage:  "Which network to connect each NIC of the copied VM to, as a comma-separated list of nic-or-network=network-path, e.g. ethernet-0=/dc/network/a,ethernet-1=/dc/network/b. Every NIC must be mapped. Overrides dest-network-name.",
+			EnvVar: "VSPHERE_IMAGES_DEST_NETWORK_MAP",
+		},
+		cli.StringFlag{
+			Name:   "nic-policy",
+			Usage:  "What to do with the copied VM's NICs if no destination network is given: keep (leave them connected to the same networks) or remove",
+			EnvVar: "VSPHERE_IMAGES_NIC_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "dest-cluster-path",
+			Usage:  "The inventory path to a cluster in the destination vCenter. If set, any of the datastore, pool and host that aren't given are chosen automatically from the cluster.",
+			EnvVar: "VSPHERE_IMAGES_DEST_CLUSTER_PATH",
+		},
+		cli.StringFlag{
+			Name:   "dest-datastore-pattern",
+			Usage:  "Only choose datastores with names matching this glob pattern when placing the VM in a cluster",
+			EnvVar: "VSPHERE_IMAGES_DEST_DATASTORE_PATTERN",
+		},
+		cli.StringFlag{
+			Name:   "on-conflict",
+			Value:  "fail",
+			Usage:  "What to do if the destination VM already exists: fail, skip, replace (copy under a temporary name, then swap it in and keep the existing VM as -old) or rename-old (rename the existing VM to -old before copying)",
+			EnvVar: "VSPHERE_IMAGES_ON_CONFLICT",
+		},
+		cli.BoolFlag{
+			Name:  "check",
+			Usage: "Only check that the copy would work, and report every problem found",
+		},
+		cloneTimeoutFlag,
+	}, append(dryRunFlags, credentialFlags("src-")...)...), credentialFlags("dest-")...),
 }
 
 func copyImageAction(c *cli.Context) error {
@@ -77,32 +147,225 @@ func copyImageAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing destination URL failed")
 	}
 
-	ctx := context.Background()
+	srcURL, err = withCredentials(c, "src-", srcURL)
+	if err != nil {
+		return err
+	}
+	destURL, err = withCredentials(c, "dest-", destURL)
+	if err != nil {
+		return err
+	}
+
+	ctx := commandCtx
 
 	source := vsphereimages.ImageSource{
 		VSphereEndpoint:           srcURL,
 		VSphereInsecureSkipVerify: c.Bool("src-insecure-skip-verify"),
-		VMPath: c.Args().Get(0),
+		VSphereCAFile:             c.String("src-ca-file"),
+		VSphereSHA256Fingerprint:  c.String("src-sha256-fingerprint"),
+		VMPath:                    c.Args().Get(0),
+	}
+
+	template, err := copyImageDestinationTemplate(ctx, c, destURL)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("check") {
+		return checkCopyImage(ctx, c, source, template)
+	}
+
+	if c.Bool("dry-run") {
+		return planCopyImage(c, source, template)
+	}
+
+	if c.NArg() > 2 {
+		return copyImageToDestinations(ctx, c, source, template)
+	}
+
+	destination := copyImageDestination(template, c.Args().Get(1))
+
+	logger := newProgressLogger("Copying image… ")
+	err = vsphereimages.CopyImage(ctx, source, destination, logger)
+	if err != nil {
+		return errors.Wrap(err, "copying image failed")
+	}
+	logger.Wait()
+
+	return nil
+}
+
+// copyImageToDestinations copies the source image to every destination image
+// name given, all at the same time.
+func copyImageToDestinations(ctx context.Context, c *cli.Context, source vsphereimages.ImageSource, template vsphereimages.ImageDestination) error {
+	var destinations []vsphereimages.ImageDestination
+	for _, destPath := range c.Args().Tail() {
+		destinations = append(destinations, copyImageDestination(template, destPath))
+	}
+
+	var loggers []progressSinker
+	errs := vsphereimages.CopyImageToDestinations(ctx, source, destinations, func(destination vsphereimages.ImageDestination) progress.Sinker {
+		logger := newConcurrentProgressLogger(fmt.Sprintf("Copying image to %s… ", path.Join(destination.FolderPath, destination.VMName)))
+		loggers = append(loggers, logger)
+		return logger
+	})
+	for _, logger := range loggers {
+		logger.Wait()
+	}
+
+	failed := 0
+	for i, err := range errs {
+		destPath := path.Join(destinations[i].FolderPath, destinations[i].VMName)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Copying image to %s failed: %v\n", destPath, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Copying image to %s… OK\n", destPath)
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("copying image failed for %d of %d destinations", failed, len(destinations))
+	}
+
+	return nil
+}
+
+// checkCopyImage validates the copy to every destination image name given,
+// and prints the problems found.
+func checkCopyImage(ctx context.Context, c *cli.Context, source vsphereimages.ImageSource, template vsphereimages.ImageDestination) error {
+	failed := 0
+	for _, destPath := range c.Args().Tail() {
+		err := vsphereimages.ValidateCopy(ctx, source, copyImageDestination(template, destPath))
+		if problems, ok := err.(*vsphereimages.CopyProblems); ok {
+			failed++
+			fmt.Fprintf(os.Stderr, "Copying image to %s would fail:\n", destPath)
+			for _, problem := range problems.Problems {
+				fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "checking copy failed")
+		}
+
+		fmt.Fprintf(os.Stderr, "Copying image to %s… OK\n", destPath)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("copying image would fail for %d of %d destinations", failed, c.NArg()-1)
+	}
+
+	return nil
+}
+
+// planCopyImage prints the actions that copying the source image to every
+// destination image name given would take.
+func planCopyImage(c *cli.Context, source vsphereimages.ImageSource, template vsphereimages.ImageDestination) error {
+	for _, destPath := range c.Args().Tail() {
+		ctx, plan, err := planContext(c)
+		if err != nil {
+			return err
+		}
+
+		if err = vsphereimages.CopyImage(ctx, source, copyImageDestination(template, destPath), nil); err != nil {
+			return errors.Wrapf(err, "planning the copy to %s failed", destPath)
+		}
+
+		if err = printPlan(c, "Copying "+source.VMPath+" to "+destPath, plan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyImageDestinationTemplate builds the destination from the flags, except
+// for the folder and VM name. If a cluster is given, the placement is chosen
+// once here so that it can be logged.
+func copyImageDestinationTemplate(ctx context.Context, c *cli.Context, destURL *url.URL) (vsphereimages.ImageDestination, error) {
+	onConflict, err := vsphereimages.ParseConflictPolicy(c.String("on-conflict"))
+	if err != nil {
+		return vsphereimages.ImageDestination{}, err
+	}
+
+	networks, err := vsphereimages.ParseNetworkMapping(c.String("dest-network-map"))
+	if err != nil {
+		return vsphereimages.ImageDestination{}, err
+	}
+
+	nicPolicy, err := vsphereimages.ParseNICPolicy(c.String("nic-policy"))
+	if err != nil {
+		return vsphereimages.ImageDestination{}, err
 	}
 
 	destination := vsphereimages.ImageDestination{
 		VSphereEndpoint:           destURL,
 		VSphereInsecureSkipVerify: c.Bool("dest-insecure-skip-verify"),
+		VSphereCAFile:             c.String("dest-ca-file"),
+		VSphereSHA256Fingerprint:  c.String("dest-sha256-fingerprint"),
 		VSphereSHA1Fingerprint:    c.String("dest-sha1-fingerprint"),
-		FolderPath:                path.Dir(c.Args().Get(1)),
 		DatastorePath:             c.String("dest-datastore-path"),
 		ResourcePoolPath:          c.String("dest-pool-path"),
 		HostPath:                  c.String("dest-host-path"),
-		VMName:                    path.Base(c.Args().Get(1)),
+		FolderPath:                c.String("dest-folder-path"),
 		NetworkPath:               c.String("dest-network-name"),
+		Networks:                  networks,
+		NICPolicy:                 nicPolicy,
+		ClusterPath:               c.String("dest-cluster-path"),
+		DatastorePattern:          c.String("dest-datastore-pattern"),
+		OnConflict:                onConflict,
+		CloneTimeout:              c.Duration("clone-timeout"),
 	}
 
-	logger := newProgressLogger("Copying image… ")
-	err = vsphereimages.CopyImage(ctx, source, destination, logger)
+	if !destination.NeedsPlacement() {
+		return destination, nil
+	}
+
+	client, err := vsphereimages.NewClientWithTLS(ctx, destURL, destination.TLSOptions())
 	if err != nil {
-		return errors.Wrap(err, "copying image failed")
+		return destination, errors.Wrap(err, "creating destination vSphere client failed")
 	}
-	logger.Wait()
+	defer client.Logout(ctx)
 
-	return nil
+	placement, err := client.PlaceImage(ctx, destination.ClusterPath, destination.DatastorePattern)
+	if err != nil {
+		return destination, errors.Wrap(err, "choosing where to put the image failed")
+	}
+	destination.FillPlacement(placement)
+
+	fmt.Fprintf(os.Stderr, "Placing image on datastore %s (%s free), pool %s and host %s\n",
+		destination.DatastorePath, formatBytes(placement.DatastoreFreeSpace), destination.ResourcePoolPath, destination.HostPath)
+
+	return destination, nil
+}
+
+// copyImageDestination returns the destination for the destination image name
+// destPath, which is put in --dest-folder-path if it isn't an inventory path.
+func copyImageDestination(template vsphereimages.ImageDestination, destPath string) vsphereimages.ImageDestination {
+	destination := template
+	if template.FolderPath != "" && !strings.Contains(destPath, "/") {
+		destination.VMName = destPath
+		return destination
+	}
+
+	destination.FolderPath = path.Dir(destPath)
+	destination.VMName = path.Base(destPath)
+	return destination
+}
+
+// formatBytes formats a number of bytes using binary units, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
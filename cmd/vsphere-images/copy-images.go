@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+var copyImagesCommand = cli.Command{
+	Name:      "copy-images",
+	Usage:     "copy the images listed in a manifest file between vCenters",
+	ArgsUsage: "manifest-path",
+	Action:    copyImagesAction,
+	Flags: append([]cli.Flag{
+		cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "How many copies to run at the same time. Overrides the concurrency set in the manifest.",
+		},
+		cli.StringFlag{
+			Name:  "on-conflict",
+			Usage: "What to do if a destination VM already exists: fail, skip, replace or rename-old. Overrides the on_conflict set in the manifest.",
+		},
+		cli.DurationFlag{
+			Name:  "clone-timeout",
+			Usage: "How long each clone may take before it is cancelled and rolled back. Overrides the clone_timeout set in the manifest.",
+		},
+	}, dryRunFlags...),
+}
+
+// copyManifest describes a batch of image copies. It is read from a YAML or
+// TOML file.
+type copyManifest struct {
+	// Concurrency is how many copies to run at the same time.
+	Concurrency int `yaml:"concurrency" toml:"concurrency"`
+
+	// OnConflict is what to do if a destination VM already exists. See
+	// vsphereimages.ParseConflictPolicy.
+	OnConflict string `yaml:"on_conflict" toml:"on_conflict"`
+
+	// CloneTimeout is how long each clone may take, e.g. "2h". Without it,
+	// there is no limit.
+	CloneTimeout string `yaml:"clone_timeout" toml:"clone_timeout"`
+
+	// VCenters are the vCenters to copy from and to, by name.
+	VCenters map[string]manifestVCenter `yaml:"vcenters" toml:"vcenters"`
+
+	// Destinations are the places to copy images to, by name.
+	Destinations map[string]manifestDestination `yaml:"destinations" toml:"destinations"`
+
+	// Images are the images to copy.
+	Images []manifestImage `yaml:"images" toml:"images"`
+}
+
+type manifestVCenter struct {
+	// Profile is the name of a profile in the config file, which is used
+	// for any settings that aren't given here. Its datastore, pool, host,
+	// network, folder and cluster are used for destinations in the vCenter.
+	Profile string `yaml:"profile" toml:"profile"`
+
+	URL                string `yaml:"url" toml:"url"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	SHA256Fingerprint  string `yaml:"sha256_fingerprint" toml:"sha256_fingerprint"`
+	SHA1Fingerprint    string `yaml:"sha1_fingerprint" toml:"sha1_fingerprint"`
+	Username           string `yaml:"username" toml:"username"`
+	PasswordFile       string `yaml:"password_file" toml:"password_file"`
+	CredentialHelper   string `yaml:"credential_helper" toml:"credential_helper"`
+}
+
+type manifestDestination struct {
+	VCenter       string `yaml:"vcenter" toml:"vcenter"`
+	FolderPath    string `yaml:"folder" toml:"folder"`
+	DatastorePath string `yaml:"datastore" toml:"datastore"`
+	PoolPath      string `yaml:"pool" toml:"pool"`
+	HostPath      string `yaml:"host" toml:"host"`
+	NetworkPath   string `yaml:"network" toml:"network"`
+
+	// Networks maps NICs, by device name or current network name, to
+	// networks. It overrides NetworkPath.
+	Networks map[string]string `yaml:"networks" toml:"networks"`
+
+	// NICPolicy is what to do with the NICs if no network is given. See
+	// vsphereimages.ParseNICPolicy.
+	NICPolicy string `yaml:"nic_policy" toml:"nic_policy"`
+
+	// ClusterPath and DatastorePattern are used to choose the datastore,
+	// pool and host automatically if they aren't given.
+	ClusterPath      string `yaml:"cluster" toml:"cluster"`
+	DatastorePattern string `yaml:"datastore_pattern" toml:"datastore_pattern"`
+}
+
+type manifestImage struct {
+	VCenter      string   `yaml:"vcenter" toml:"vcenter"`
+	Path         string   `yaml:"path" toml:"path"`
+	Name         string   `yaml:"name" toml:"name"`
+	Destinations []string `yaml:"destinations" toml:"destinations"`
+}
+
+// copyJob is a single image copied to a single destination.
+type copyJob struct {
+	image       manifestImage
+	destination string
+	err         error
+
+	// plan is what the copy would do, with --dry-run.
+	plan *vsphereimages.Plan
+}
+
+func copyImagesAction(c *cli.Context) error {
+	manifestPath := c.Args().Get(0)
+	if manifestPath == "" {
+		return errors.New("manifest path is required")
+	}
+
+	manifest, err := readCopyManifest(manifestPath)
+	if err != nil {
+		return errors.Wrap(err, "reading manifest failed")
+	}
+
+	if err = applyManifestProfiles(c.GlobalString("config"), manifest); err != nil {
+		return err
+	}
+
+	concurrency := manifest.Concurrency
+	if c.Int("concurrency") > 0 {
+		concurrency = c.Int("concurrency")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	if c.String("on-conflict") != "" {
+		manifest.OnConflict = c.String("on-conflict")
+	}
+	onConflict, err := vsphereimages.ParseConflictPolicy(manifest.OnConflict)
+	if err != nil {
+		return err
+	}
+
+	cloneTimeout := c.Duration("clone-timeout")
+	if cloneTimeout == 0 && manifest.CloneTimeout != "" {
+		cloneTimeout, err = time.ParseDuration(manifest.CloneTimeout)
+		if err != nil {
+			return errors.Wrap(err, "parsing clone_timeout failed")
+		}
+	}
+
+	var jobs []*copyJob
+	for _, image := range manifest.Images {
+		for _, destination := range image.Destinations {
+			jobs = append(jobs, &copyJob{image: image, destination: destination})
+		}
+	}
+
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+	clients := newClientPool(manifest.VCenters)
+	defer clients.logout(ctx)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *copyJob) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			jobCtx := ctx
+			if plan != nil {
+				// every copy gets a plan of its own, since they run at
+				// the same time
+				job.plan = &vsphereimages.Plan{}
+				jobCtx = vsphereimages.WithPlan(commandCtx, job.plan)
+			}
+
+			job.err = runCopyJob(jobCtx, manifest, clients, onConflict, cloneTimeout, job)
+			if job.err != nil {
+				fmt.Fprintf(os.Stderr, "Copying %s to %s failed: %v\n", job.image.Path, job.destination, job.err)
+			} else if plan == nil {
+				fmt.Fprintf(os.Stderr, "Copied %s to %s\n", job.image.Path, job.destination)
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	if plan != nil {
+		return printCopyJobPlans(c, jobs)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tDESTINATION\tRESULT")
+	for _, job := range jobs {
+		result := "ok"
+		if job.err != nil {
+			result = "failed: " + job.err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", job.image.Path, job.destination, result)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d copies failed", failed, len(jobs))
+	}
+
+	return nil
+}
+
+// printCopyJobPlans prints what each of the jobs would do, in the order they
+// are listed in the manifest.
+func printCopyJobPlans(c *cli.Context, jobs []*copyJob) error {
+	failed := 0
+	for _, job := range jobs {
+		if job.err != nil {
+			failed++
+			continue
+		}
+
+		if err := printPlan(c, "Copying "+job.image.Path+" to "+job.destination, job.plan); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("planning %d of %d copies failed", failed, len(jobs))
+	}
+
+	return nil
+}
+
+func runCopyJob(ctx context.Context, manifest *copyManifest, clients *clientPool, onConflict vsphereimages.ConflictPolicy, cloneTimeout time.Duration, job *copyJob) error {
+	destination, ok := manifest.Destinations[job.destination]
+	if !ok {
+		return errors.Errorf("unknown destination %q", job.destination)
+	}
+
+	srcClient, err := clients.get(ctx, job.image.VCenter)
+	if err != nil {
+		return errors.Wrap(err, "connecting to source vCenter failed")
+	}
+
+	destClient, err := clients.get(ctx, destination.VCenter)
+	if err != nil {
+		return errors.Wrap(err, "connecting to destination vCenter failed")
+	}
+
+	name := job.image.Name
+	if name == "" {
+		name = path.Base(job.image.Path)
+	}
+
+	nicPolicy, err := vsphereimages.ParseNICPolicy(destination.NICPolicy)
+	if err != nil {
+		return err
+	}
+
+	imageDestination := vsphereimages.ImageDestination{
+		VSphereSHA1Fingerprint: manifest.VCenters[destination.VCenter].SHA1Fingerprint,
+		FolderPath:             destination.FolderPath,
+		DatastorePath:          destination.DatastorePath,
+		ResourcePoolPath:       destination.PoolPath,
+		HostPath:               destination.HostPath,
+		NetworkPath:            destination.NetworkPath,
+		Networks:               destination.Networks,
+		NICPolicy:              nicPolicy,
+		ClusterPath:            destination.ClusterPath,
+		DatastorePattern:       destination.DatastorePattern,
+		VMName:                 name,
+		OnConflict:             onConflict,
+		CloneTimeout:           cloneTimeout,
+	}
+
+	if imageDestination.NeedsPlacement() {
+		placement, err := destClient.PlaceImage(ctx, imageDestination.ClusterPath, imageDestination.DatastorePattern)
+		if err != nil {
+			return errors.Wrap(err, "choosing where to put the image failed")
+		}
+		imageDestination.FillPlacement(placement)
+
+		fmt.Fprintf(os.Stderr, "Placing %s in %s on datastore %s (%s free) and host %s\n",
+			job.image.Path, job.destination, imageDestination.DatastorePath, formatBytes(placement.DatastoreFreeSpace), imageDestination.HostPath)
+	}
+
+	return srcClient.CopyImage(ctx, job.image.Path, destClient, imageDestination, nil)
+}
+
+// applyManifestProfiles fills in the settings of the manifest's vCenters and
+// destinations that aren't given from the vCenters' profiles.
+func applyManifestProfiles(configPath string, manifest *copyManifest) error {
+	var config *profileConfig
+	profiles := make(map[string]profile)
+	for name, vCenter := range manifest.VCenters {
+		if vCenter.Profile == "" {
+			continue
+		}
+
+		if config == nil {
+			var err error
+			config, err = readProfileConfig(configPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		p, ok := config.Profiles[vCenter.Profile]
+		if !ok {
+			return errors.Errorf("unknown profile %q for vCenter %q", vCenter.Profile, name)
+		}
+		profiles[name] = p
+
+		fillString(&vCenter.URL, p.URL)
+		vCenter.InsecureSkipVerify = vCenter.InsecureSkipVerify || p.InsecureSkipVerify
+		fillString(&vCenter.CAFile, p.CAFile)
+		fillString(&vCenter.SHA256Fingerprint, p.SHA256Fingerprint)
+		fillString(&vCenter.SHA1Fingerprint, p.SHA1Fingerprint)
+		fillString(&vCenter.Username, p.Username)
+		fillString(&vCenter.PasswordFile, p.PasswordFile)
+		fillString(&vCenter.CredentialHelper, p.CredentialHelper)
+		manifest.VCenters[name] = vCenter
+	}
+
+	for name, destination := range manifest.Destinations {
+		p, ok := profiles[destination.VCenter]
+		if !ok {
+			continue
+		}
+
+		fillString(&destination.FolderPath, p.FolderPath)
+		fillString(&destination.DatastorePath, p.DatastorePath)
+		fillString(&destination.PoolPath, p.PoolPath)
+		fillString(&destination.HostPath, p.HostPath)
+		fillString(&destination.NetworkPath, p.NetworkPath)
+		fillString(&destination.ClusterPath, p.ClusterPath)
+		manifest.Destinations[name] = destination
+	}
+
+	return nil
+}
+
+func fillString(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}
+
+func readCopyManifest(manifestPath string) (*copyManifest, error) {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest copyManifest
+	switch filepath.Ext(manifestPath) {
+	case ".toml":
+		err = toml.Unmarshal(b, &manifest)
+	default:
+		err = yaml.Unmarshal(b, &manifest)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing manifest failed")
+	}
+
+	return &manifest, nil
+}
+
+// clientPool connects to each vCenter in a manifest once, the first time
+// it's needed, so that copies to and from the same vCenter share a session.
+type clientPool struct {
+	vCenters map[string]manifestVCenter
+
+	mutex   sync.Mutex
+	entries map[string]*clientPoolEntry
+}
+
+// clientPoolEntry is the connection to a vCenter in a clientPool. Only the
+// jobs for the same vCenter wait for each other to connect to it, so a slow
+// vCenter doesn't hold up the jobs for the others.
+type clientPoolEntry struct {
+	once   sync.Once
+	client *vsphereimages.Client
+	err    error
+}
+
+func newClientPool(vCenters map[string]manifestVCenter) *clientPool {
+	return &clientPool{
+		vCenters: vCenters,
+		entries:  make(map[string]*clientPoolEntry),
+	}
+}
+
+func (p *clientPool) get(ctx context.Context, name string) (*vsphereimages.Client, error) {
+	p.mutex.Lock()
+	entry, ok := p.entries[name]
+	if !ok {
+		entry = &clientPoolEntry{}
+		p.entries[name] = entry
+	}
+	p.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.client, entry.err = p.connect(ctx, name)
+	})
+	return entry.client, entry.err
+}
+
+func (p *clientPool) connect(ctx context.Context, name string) (*vsphereimages.Client, error) {
+	vCenter, ok := p.vCenters[name]
+	if !ok {
+		return nil, errors.Errorf("unknown vCenter %q", name)
+	}
+
+	u, err := url.Parse(vCenter.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing vSphere URL failed")
+	}
+
+	credentials := vsphereimages.CredentialOptions{
+		Username:     vCenter.Username,
+		PasswordFile: vCenter.PasswordFile,
+		Helper:       vCenter.CredentialHelper,
+	}
+	u, err = credentials.WithCredentials(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting vSphere credentials failed")
+	}
+
+	return vsphereimages.NewClientWithTLS(ctx, u, vsphereimages.TLSOptions{
+		InsecureSkipVerify: vCenter.InsecureSkipVerify,
+		CAFile:             vCenter.CAFile,
+		SHA256Fingerprint:  vCenter.SHA256Fingerprint,
+	})
+}
+
+func (p *clientPool) logout(ctx context.Context) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, entry := range p.entries {
+		// waits for the entry to be connected to, if it is being
+		entry.once.Do(func() {})
+		if entry.client != nil {
+			entry.client.Logout(ctx)
+		}
+	}
+}
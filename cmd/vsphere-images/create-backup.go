@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var createBackupCommand = cli.Command{
+	Name:      "create-backup",
+	Usage:     "clone an image into a timestamped backup",
+	ArgsUsage: "image-path",
+	Action:    createBackupAction,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "vsphere-url",
+			Usage:  "URL to the vSphere SDK API",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_URL",
+		},
+		cli.BoolFlag{
+			Name:   "vsphere-insecure-skip-verify",
+			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "datastore-path",
+			Usage:  "The inventory path to the datastore to put the backup in. Defaults to the image's datastore.",
+			EnvVar: "VSPHERE_IMAGES_DATASTORE_PATH",
+		},
+		cli.StringFlag{
+			Name:  "backup-folder-path",
+			Usage: "The inventory path to the folder the backup should be created in",
+		},
+		cloneTimeoutFlag,
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
+}
+
+func createBackupAction(c *cli.Context) error {
+	vSphereStringURL := c.String("vsphere-url")
+	if vSphereStringURL == "" {
+		return errors.New("the 'vsphere-url' flag is required")
+	}
+
+	vSphereURL, err := url.Parse(vSphereStringURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing vSphere URL failed")
+	}
+
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
+	imagePath := c.Args().Get(0)
+	if imagePath == "" {
+		return errors.New("image inventory path is required")
+	}
+
+	backupFolderPath := c.String("backup-folder-path")
+	if backupFolderPath == "" {
+		return errors.New("the 'backup-folder-path' flag is required")
+	}
+
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+	logger := newProgressLogger("Creating backup image… ")
+	backupPath, err := client.CreateBackup(ctx, imagePath, backupFolderPath, c.String("datastore-path"), backupOptions(c), logger)
+	if err != nil {
+		return errors.Wrap(err, "creating backup image failed")
+	}
+	logger.Wait()
+
+	if plan != nil {
+		return printPlan(c, "Backing up "+imagePath+" to "+backupPath, plan)
+	}
+
+	fmt.Println(backupPath)
+
+	return nil
+}
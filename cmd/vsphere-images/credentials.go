@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+// credentialFlags returns the flags for giving credentials for a vCenter
+// without putting them in its URL. prefix is put in front of the flag names,
+// e.g. "src-" for the source vCenter of a copy.
+//
+// There is no flag for the password itself, since flags show up in process
+// listings. It can be given with the <PREFIX>PASSWORD environment variable
+// instead, e.g. VSPHERE_IMAGES_SRC_PASSWORD.
+func credentialFlags(prefix string) []cli.Flag {
+	envPrefix := credentialEnvPrefix(prefix)
+
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   prefix + "username",
+			Usage:  "The username to log in to vCenter with, instead of the one in the URL",
+			EnvVar: envPrefix + "USERNAME",
+		},
+		cli.StringFlag{
+			Name:   prefix + "password-file",
+			Usage:  "A file containing the password to log in to vCenter with. The password can also be given in the " + envPrefix + "PASSWORD environment variable.",
+			EnvVar: envPrefix + "PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   prefix + "credential-helper",
+			Usage:  "A command that prints the username and password to log in to vCenter with, like a git credential helper",
+			EnvVar: envPrefix + "CREDENTIAL_HELPER",
+		},
+	}
+}
+
+func credentialEnvPrefix(prefix string) string {
+	return "VSPHERE_IMAGES_" + strings.ToUpper(strings.Replace(prefix, "-", "_", -1))
+}
+
+// withCredentials returns a copy of u with the credentials given by the flags
+// from credentialFlags(prefix).
+func withCredentials(c *cli.Context, prefix string, u *url.URL) (*url.URL, error) {
+	options := vsphereimages.CredentialOptions{
+		Username:     c.String(prefix + "username"),
+		Password:     os.Getenv(credentialEnvPrefix(prefix) + "PASSWORD"),
+		PasswordFile: c.String(prefix + "password-file"),
+		Helper:       c.String(prefix + "credential-helper"),
+	}
+
+	u, err := options.WithCredentials(commandCtx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting vSphere credentials failed")
+	}
+
+	return u, nil
+}
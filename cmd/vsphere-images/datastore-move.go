@@ -1,11 +1,9 @@
 package main
 
 import (
-	"context"
 	"net/url"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -14,7 +12,7 @@ var datastoreMoveCommand = cli.Command{
 	Usage:     "Move the image on the underlying datastore",
 	ArgsUsage: "image-inventory-path src-datastore-path dest-datastore-path",
 	Action:    datastoreMoveAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -25,7 +23,7 @@ var datastoreMoveCommand = cli.Command{
 			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
 			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
 		},
-	},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func datastoreMoveAction(c *cli.Context) error {
@@ -39,6 +37,11 @@ func datastoreMoveAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	if c.NArg() != 3 {
 		return errors.New("required arguments: image-inventory-path src-datastore-path dest-datastore-path")
 	}
@@ -46,14 +49,23 @@ func datastoreMoveAction(c *cli.Context) error {
 	imagePath := c.Args().Get(0)
 	srcDatastorePath := c.Args().Get(1)
 	destDatastorePath := c.Args().Get(2)
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Moving image… ")
 
-	err = vsphereimages.DatastoreMoveImage(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), imagePath, srcDatastorePath, destDatastorePath, logger)
+	err = client.DatastoreMoveImage(ctx, imagePath, srcDatastorePath, destDatastorePath, logger)
 	if err != nil {
 		return errors.Wrap(err, "moving image failed")
 	}
 	logger.Wait()
 
-	return nil
+	return printPlan(c, "Moving the files of "+imagePath+" to "+destDatastorePath, plan)
 }
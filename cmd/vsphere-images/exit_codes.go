@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+// The exit codes for the errors automation is likely to handle differently,
+// besides exitTimedOut and exitInterrupted. They are listed in the README, and
+// scripts depend on them, so they must not change.
+const (
+	exitError             = 1
+	exitNotFound          = 2
+	exitAlreadyExists     = 3
+	exitAlreadyCheckedOut = 4
+	exitNotCheckedOut     = 5
+	exitNoAvailableHost   = 6
+	exitInsufficientSpace = 7
+	exitFault             = 8
+)
+
+// withExitCode wraps a command's action, or the app's Before, so that the
+// error it fails with is printed once and the process exits with the code for
+// it, which cli does for a *cli.ExitError.
+func withExitCode(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		err := action(c)
+		if _, ok := err.(cli.ExitCoder); ok {
+			// the action chose its own exit code
+			return err
+		}
+
+		switch {
+		case err == nil:
+			return nil
+		case timedOut(err) && commandCtx.Err() == context.DeadlineExceeded:
+			return cli.NewExitError(fmt.Sprintf("timed out after %s: %v", commandTimeout, err), exitTimedOut)
+		case timedOut(err):
+			return cli.NewExitError(fmt.Sprintf("timed out: %v", err), exitTimedOut)
+		case commandCtx.Err() != nil:
+			return cli.NewExitError(fmt.Sprintf("interrupted: %v", err), exitInterrupted)
+		}
+
+		return cli.NewExitError(fmt.Sprintf("an error occurred: %v", err), exitCode(err))
+	}
+}
+
+// exitCode returns the exit code for a command that failed with err, other
+// than by timing out or being interrupted.
+func exitCode(err error) int {
+	switch errors.Cause(err).(type) {
+	case *vsphereimages.AlreadyCheckedOutError:
+		return exitAlreadyCheckedOut
+	case *vsphereimages.NoAvailableHostError:
+		return exitNoAvailableHost
+	}
+
+	switch {
+	case vsphereimages.IsInsufficientSpace(err):
+		return exitInsufficientSpace
+	case vsphereimages.IsAlreadyExists(err):
+		return exitAlreadyExists
+	case vsphereimages.IsNotFound(err):
+		return exitNotFound
+	}
+
+	if _, ok := vsphereimages.AsFault(err); ok {
+		return exitFault
+	}
+
+	return exitError
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// progressEvent is a line of JSON progress output.
+type progressEvent struct {
+	// Type is "step_started", "progress" or "step_finished" for a step,
+	// "retry" when a step is tried again after a transient fault, and
+	// "finished" once the task is done.
+	Type string `json:"type"`
+
+	// Task is what the command is doing, e.g. "Copying image".
+	Task string `json:"task"`
+
+	// Step counts the steps of the task from 1, in the order they started.
+	// If the operation names its steps, Name is the name of the step and
+	// TotalSteps is how many steps there are.
+	Step       int    `json:"step,omitempty"`
+	TotalSteps int    `json:"total_steps,omitempty"`
+	Name       string `json:"name,omitempty"`
+
+	// Attempt and MaxAttempts count the attempts at a step that is retried,
+	// and RetryIn is how long it is until the next attempt.
+	Attempt     int    `json:"attempt,omitempty"`
+	MaxAttempts int    `json:"max_attempts,omitempty"`
+	RetryIn     string `json:"retry_in,omitempty"`
+
+	Percentage *float32 `json:"percentage,omitempty"`
+	Detail     string   `json:"detail,omitempty"`
+	Error      string   `json:"error,omitempty"`
+
+	Time      time.Time  `json:"time"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+// jsonProgressLogger prints a JSON object on its own line for every progress
+// report and whenever a step starts or finishes, for CI jobs and other tools
+// to parse. Each time Sink is called is a new step, and steps may run at the
+// same time, unless the operation names its steps.
+type jsonProgressLogger struct {
+	task      string
+	startedAt time.Time
+	wg        sync.WaitGroup
+
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	steps   int
+	failed  bool
+
+	// named is the step the operation said it was starting, or the step
+	// that is being retried, which the next call to Sink is for.
+	named *progressEvent
+
+	// last is the step the last call to Sink was for.
+	last *progressEvent
+}
+
+func newJSONProgressLogger(prefix string) *jsonProgressLogger {
+	return &jsonProgressLogger{
+		task:      strings.TrimSuffix(strings.TrimSpace(prefix), "…"),
+		startedAt: time.Now(),
+		encoder:   json.NewEncoder(os.Stderr),
+	}
+}
+
+// Step prints a "step_started" event for a step the operation names. Named
+// steps run one at a time, so the earlier steps are waited on first to keep
+// their events in order.
+func (p *jsonProgressLogger) Step(number int, total int, name string) {
+	p.wg.Wait()
+
+	startedAt := time.Now()
+	step := progressEvent{Step: number, TotalSteps: total, Name: name, StartedAt: &startedAt}
+
+	p.mutex.Lock()
+	p.steps = number
+	p.named = &step
+	p.mutex.Unlock()
+
+	started := step
+	started.Type = "step_started"
+	p.print(started)
+}
+
+func (p *jsonProgressLogger) Sink() chan<- progress.Report {
+	p.mutex.Lock()
+	step := p.named
+	p.named = nil
+	if step == nil {
+		p.steps++
+		startedAt := time.Now()
+		step = &progressEvent{Step: p.steps, StartedAt: &startedAt}
+	}
+	p.last = step
+	p.mutex.Unlock()
+
+	// steps the operation named have already been announced by Step
+	if step.Name == "" {
+		started := *step
+		started.Type = "step_started"
+		p.print(started)
+	}
+
+	ch := make(chan progress.Report)
+	p.wg.Add(1)
+	go p.loop(*step, ch)
+	return ch
+}
+
+// Retry prints a "retry" event for the step that was running last, which the
+// next call to Sink is for again.
+func (p *jsonProgressLogger) Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+	p.wg.Wait()
+
+	p.mutex.Lock()
+	retry := progressEvent{Name: name}
+	if p.last != nil {
+		retry = *p.last
+		p.named = p.last
+	}
+	p.mutex.Unlock()
+
+	if retry.Name == "" {
+		retry.Name = name
+	}
+	retry.Type = "retry"
+	retry.Attempt = attempt
+	retry.MaxAttempts = maxAttempts
+	retry.RetryIn = delay.String()
+	retry.Error = err.Error()
+	p.print(retry)
+}
+
+func (p *jsonProgressLogger) loop(step progressEvent, ch <-chan progress.Report) {
+	defer p.wg.Done()
+
+	var err error
+	for r := range ch {
+		if r.Error() != nil {
+			err = r.Error()
+			continue
+		}
+
+		percentage := r.Percentage()
+		report := step
+		report.Type = "progress"
+		report.Percentage = &percentage
+		report.Detail = r.Detail()
+		p.print(report)
+	}
+
+	finished := step
+	finished.Type = "step_finished"
+	if err != nil && err != io.EOF {
+		finished.Error = err.Error()
+
+		p.mutex.Lock()
+		p.failed = true
+		p.mutex.Unlock()
+	}
+	p.print(finished)
+}
+
+func (p *jsonProgressLogger) print(event progressEvent) {
+	event.Task = p.task
+	event.Time = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.encoder.Encode(event)
+}
+
+// Wait waits for all of the steps to finish, and prints a "finished" event
+// unless any of them failed.
+func (p *jsonProgressLogger) Wait() {
+	p.wg.Wait()
+
+	if !p.failed {
+		p.print(progressEvent{Type: "finished", StartedAt: &p.startedAt})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+var listImagesCommand = cli.Command{
+	Name:      "list-images",
+	Usage:     "List the images in a folder",
+	ArgsUsage: "folder-path",
+	Action:    listImagesAction,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "vsphere-url",
+			Usage:  "URL to the vSphere SDK API",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_URL",
+		},
+		cli.BoolFlag{
+			Name:   "vsphere-insecure-skip-verify",
+			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
+		},
+		cli.BoolFlag{
+			Name:  "recursive, r",
+			Usage: "Whether images in sub-folders should be listed too",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "Only list images with names matching this shell pattern",
+		},
+		cli.StringFlag{
+			Name:  "name-regexp",
+			Usage: "Only list images with names matching this regular expression",
+		},
+		cli.StringFlag{
+			Name:  "guest",
+			Usage: "Only list images with a guest ID or guest OS name matching this shell pattern",
+		},
+		cli.StringSliceFlag{
+			Name:  "attribute",
+			Usage: "Only list images with this custom attribute, given as name=value. Can be given multiple times.",
+		},
+		cli.StringFlag{
+			Name:  "annotation",
+			Usage: "Only list images with annotations containing this string",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "The output format, one of table, json or yaml",
+			Value: "table",
+		},
+	}, append(vSphereTLSFlags, credentialFlags("")...)...),
+}
+
+func listImagesAction(c *cli.Context) error {
+	vSphereStringURL := c.String("vsphere-url")
+	if vSphereStringURL == "" {
+		return errors.New("the 'vsphere-url' flag is required")
+	}
+
+	vSphereURL, err := url.Parse(vSphereStringURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing vSphere URL failed")
+	}
+
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
+	folderPath := c.Args().Get(0)
+	if folderPath == "" {
+		return errors.New("folder inventory path is required")
+	}
+
+	write, ok := imageWriters[c.String("output")]
+	if !ok {
+		return errors.Errorf("unknown output format %q", c.String("output"))
+	}
+
+	filter := vsphereimages.ImageFilter{
+		Name:       c.String("name"),
+		Guest:      c.String("guest"),
+		Annotation: c.String("annotation"),
+	}
+
+	if nameRegexp := c.String("name-regexp"); nameRegexp != "" {
+		filter.NameRegexp, err = regexp.Compile(nameRegexp)
+		if err != nil {
+			return errors.Wrap(err, "parsing name regexp failed")
+		}
+	}
+
+	for _, attribute := range c.StringSlice("attribute") {
+		parts := strings.SplitN(attribute, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("custom attribute %q should be given as name=value", attribute)
+		}
+
+		if filter.CustomAttributes == nil {
+			filter.CustomAttributes = make(map[string]string)
+		}
+		filter.CustomAttributes[parts[0]] = parts[1]
+	}
+
+	ctx := commandCtx
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+
+	infos, err := client.FindImages(ctx, folderPath, c.Bool("recursive"), filter)
+	if err != nil {
+		return errors.Wrap(err, "listing images failed")
+	}
+
+	return write(os.Stdout, infos)
+}
+
+var imageWriters = map[string]func(io.Writer, []vsphereimages.ImageInfo) error{
+	"table": writeImagesTable,
+	"json":  writeImagesJSON,
+	"yaml":  writeImagesYAML,
+}
+
+func writeImagesTable(w io.Writer, infos []vsphereimages.ImageInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPATH\tDATASTORE\tGUEST\tCPUS\tRAM (MB)\tSNAPSHOTS\tPOWER\tMODIFIED")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			info.Name,
+			info.InventoryPath,
+			strings.Join(info.Datastores, ","),
+			info.GuestID,
+			info.NumCPUs,
+			info.MemoryMB,
+			strings.Join(info.Snapshots, ","),
+			info.PowerState,
+			info.Modified.Format(time.RFC3339),
+		)
+	}
+	return tw.Flush()
+}
+
+func writeImagesJSON(w io.Writer, infos []vsphereimages.ImageInfo) error {
+	if infos == nil {
+		infos = []vsphereimages.ImageInfo{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(infos)
+}
+
+func writeImagesYAML(w io.Writer, infos []vsphereimages.ImageInfo) error {
+	b, err := yaml.Marshal(infos)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
@@ -14,21 +14,52 @@ func main() {
 	app.Author = "Travis CI GmbH"
 	app.Email = "contact+vsphere-images@travis-ci.org"
 
+	app.Flags = append(profileFlags, cli.StringFlag{
+		Name:   "progress",
+		Value:  "tty",
+		Usage:  "How to print progress: tty (redraw the current line), plain (a line every 10%) or json (a JSON object per line on stderr)",
+		EnvVar: "VSPHERE_IMAGES_PROGRESS",
+	}, timeoutFlag)
+	app.Flags = append(app.Flags, retryFlags...)
+	app.Before = withExitCode(func(c *cli.Context) error {
+		applyTimeout(c)
+		if err := applyRetryPolicy(c); err != nil {
+			return err
+		}
+
+		switch progressFormat = c.GlobalString("progress"); progressFormat {
+		case "tty", "plain", "json":
+			return nil
+		}
+		return errors.Errorf("unknown progress format %q, must be tty, plain or json", progressFormat)
+	})
+
 	app.Commands = []cli.Command{
 		checkinHostCommand,
 		checkoutHostCommand,
 		copyImageCommand,
+		copyImagesCommand,
+		listImagesCommand,
 		moveImageCommand,
 		configureImageCommand,
 		migrateImageCommand,
 		resnapshotCommand,
 		datastoreMoveCommand,
+		createBackupCommand,
 		restoreBackupCommand,
+		pruneBackupsCommand,
+		rollbackImageCommand,
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "an error occurred: %v\n", err)
-		os.Exit(1)
+	for i := range app.Commands {
+		app.Commands[i].Action = withExitCode(withProfiles(app.Commands[i].Action))
+	}
+
+	handleSignals()
+
+	// cli has already printed any error, along with the usage for errors in
+	// the arguments, and commands exit with their own codes
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(exitError)
 	}
 }
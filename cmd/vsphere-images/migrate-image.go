@@ -1,11 +1,9 @@
 package main
 
 import (
-	"context"
 	"net/url"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -14,7 +12,7 @@ var migrateImageCommand = cli.Command{
 	Usage:     "Migrates a VM to a new resource pool",
 	ArgsUsage: "image-inventory-path",
 	Action:    migrateImageAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -29,7 +27,7 @@ var migrateImageCommand = cli.Command{
 			Name:  "pool",
 			Usage: "The inventory path of the resource pool to migrate the VM to",
 		},
-	},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func migrateImageAction(c *cli.Context) error {
@@ -43,6 +41,11 @@ func migrateImageAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	imagePath := c.Args().Get(0)
 	if imagePath == "" {
 		return errors.New("image inventory path is required")
@@ -53,13 +56,22 @@ func migrateImageAction(c *cli.Context) error {
 		return errors.New("pool path is required")
 	}
 
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Migrating image… ")
-	err = vsphereimages.MigrateImage(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), imagePath, poolPath, logger)
+	err = client.MigrateImage(ctx, imagePath, poolPath, logger)
 	if err != nil {
 		return errors.Wrap(err, "migrating image failed")
 	}
 	logger.Wait()
 
-	return nil
+	return printPlan(c, "Migrating "+imagePath+" to "+poolPath, plan)
 }
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"context"
 	"net/url"
 	"path"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -15,7 +13,7 @@ var moveImageCommand = cli.Command{
 	Usage:     "Renames and moves a VM within a single vCenter instance",
 	ArgsUsage: "image-inventory-path",
 	Action:    moveImageAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -26,7 +24,7 @@ var moveImageCommand = cli.Command{
 			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
 			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
 		},
-	},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func moveImageAction(c *cli.Context) error {
@@ -40,6 +38,11 @@ func moveImageAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	imagePath := c.Args().Get(0)
 	if imagePath == "" {
 		return errors.New("image inventory path is required")
@@ -53,13 +56,22 @@ func moveImageAction(c *cli.Context) error {
 	destinationFolderPath := path.Dir(destinationImagePath)
 	newName := path.Base(destinationImagePath)
 
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Moving image… ")
-	err = vsphereimages.MoveImage(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), imagePath, destinationFolderPath, newName, logger)
+	err = client.MoveImage(ctx, imagePath, destinationFolderPath, newName, logger)
 	if err != nil {
 		return errors.Wrap(err, "moving image failed")
 	}
 	logger.Wait()
 
-	return nil
+	return printPlan(c, "Moving "+imagePath+" to "+destinationImagePath, plan)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// dryRunFlags make a command that changes something in vSphere print the
+// actions it would take, instead of taking them.
+var dryRunFlags = planFlags("dry-run, n")
+
+// planFlags returns the flags for printing a plan, with name as the flag that
+// turns it on. checkout-host uses --plan, since --dry-run used to mean --check
+// there.
+func planFlags(name string) []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  name,
+			Usage: "Only look up everything the command needs and print the vSphere actions it would take, in order, without changing anything",
+		},
+		cli.StringFlag{
+			Name:   "plan-format",
+			Value:  "text",
+			Usage:  "How to print the actions with --" + strings.Split(name, ",")[0] + ": text or json (a JSON object per line on stdout)",
+			EnvVar: "VSPHERE_IMAGES_PLAN_FORMAT",
+		},
+	}
+}
+
+// planning is true if the command was given --dry-run, which makes the
+// progress loggers print nothing, since no tasks are run.
+var planning bool
+
+// planContext returns the context for the command to do everything with,
+// which is commandCtx with a plan if --dry-run was given. The plan is nil
+// otherwise.
+func planContext(c *cli.Context) (context.Context, *vsphereimages.Plan, error) {
+	return planContextFor(c, "dry-run")
+}
+
+// planContextFor is planContext for a command that turns on planning with the
+// flag called name.
+func planContextFor(c *cli.Context, name string) (context.Context, *vsphereimages.Plan, error) {
+	if !c.Bool(name) {
+		return commandCtx, nil, nil
+	}
+
+	switch format := c.String("plan-format"); format {
+	case "text", "json":
+	default:
+		return nil, nil, errors.Errorf("unknown plan format %q, must be text or json", format)
+	}
+
+	planning = true
+	plan := &vsphereimages.Plan{}
+	return vsphereimages.WithPlan(commandCtx, plan), plan, nil
+}
+
+// planEvent is a line of JSON plan output.
+type planEvent struct {
+	// Task is what the command would do, e.g. "Copying image to /dc/vm/foo".
+	Task    string       `json:"task"`
+	Actions []planAction `json:"actions"`
+}
+
+type planAction struct {
+	Step   string `json:"step"`
+	Method string `json:"method"`
+	Object string `json:"object"`
+	Target string `json:"target,omitempty"`
+}
+
+// printPlan prints the actions of plan, which task would take, in the format
+// given by --plan-format. It does nothing if plan is nil.
+func printPlan(c *cli.Context, task string, plan *vsphereimages.Plan) error {
+	if plan == nil {
+		return nil
+	}
+
+	actions := plan.Actions()
+
+	if c.String("plan-format") == "json" {
+		event := planEvent{Task: task, Actions: []planAction{}}
+		for _, action := range actions {
+			event.Actions = append(event.Actions, planAction(action))
+		}
+		return json.NewEncoder(os.Stdout).Encode(event)
+	}
+
+	if len(actions) == 0 {
+		fmt.Printf("%s: nothing to do\n", task)
+		return nil
+	}
+
+	fmt.Printf("%s would take these actions:\n", task)
+	for i, action := range actions {
+		fmt.Printf("  %d. %s: %s on %s", i+1, action.Step, action.Method, action.Object)
+		if action.Target != "" {
+			fmt.Printf(" -> %s", action.Target)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// quietProgressLogger reports nothing, for commands given --dry-run.
+type quietProgressLogger struct {
+	wg sync.WaitGroup
+}
+
+func (p *quietProgressLogger) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for range ch {
+		}
+	}()
+	return ch
+}
+
+func (p *quietProgressLogger) Step(number int, total int, name string) {}
+
+func (p *quietProgressLogger) Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+}
+
+func (p *quietProgressLogger) Wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// profileConfig is the config file with the named vCenter profiles.
+type profileConfig struct {
+	Profiles map[string]profile `yaml:"profiles" toml:"profiles"`
+}
+
+// profile holds the settings for a vCenter, which are used for any flags that
+// aren't given on the command line or in the environment.
+type profile struct {
+	URL                string `yaml:"url" toml:"url"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	SHA256Fingerprint  string `yaml:"sha256_fingerprint" toml:"sha256_fingerprint"`
+	SHA1Fingerprint    string `yaml:"sha1_fingerprint" toml:"sha1_fingerprint"`
+	Username           string `yaml:"username" toml:"username"`
+	PasswordFile       string `yaml:"password_file" toml:"password_file"`
+	CredentialHelper   string `yaml:"credential_helper" toml:"credential_helper"`
+	DatastorePath      string `yaml:"datastore" toml:"datastore"`
+	PoolPath           string `yaml:"pool" toml:"pool"`
+	HostPath           string `yaml:"host" toml:"host"`
+	NetworkPath        string `yaml:"network" toml:"network"`
+	FolderPath         string `yaml:"folder" toml:"folder"`
+	ClusterPath        string `yaml:"cluster" toml:"cluster"`
+}
+
+// profileSetting is a profile value, and the flags it is used for.
+type profileSetting struct {
+	key   string
+	value string
+
+	// flags are the names of the flags the value is used for when the
+	// profile is given with --profile. prefixedFlags are the names used with
+	// --src-profile and --dest-profile, without the prefix. Settings are
+	// skipped by commands without any of their flags.
+	flags         []string
+	prefixedFlags []string
+
+	// required settings make the command fail if it has none of the flags,
+	// since silently ignoring them would be less secure.
+	required bool
+}
+
+func (p profile) settings() []profileSetting {
+	insecure := ""
+	if p.InsecureSkipVerify {
+		insecure = "true"
+	}
+
+	return []profileSetting{
+		{key: "url", value: p.URL, flags: []string{"vsphere-url"}, prefixedFlags: []string{"url"}},
+		{key: "insecure_skip_verify", value: insecure, flags: []string{"vsphere-insecure-skip-verify"}, prefixedFlags: []string{"insecure-skip-verify"}},
+		{key: "ca_file", value: p.CAFile, flags: []string{"vsphere-ca-file"}, prefixedFlags: []string{"ca-file"}, required: true},
+		{key: "sha256_fingerprint", value: p.SHA256Fingerprint, flags: []string{"vsphere-sha256-fingerprint"}, prefixedFlags: []string{"sha256-fingerprint"}, required: true},
+		{key: "sha1_fingerprint", value: p.SHA1Fingerprint, prefixedFlags: []string{"sha1-fingerprint"}},
+		{key: "username", value: p.Username, flags: []string{"username"}, prefixedFlags: []string{"username"}},
+		{key: "password_file", value: p.PasswordFile, flags: []string{"password-file"}, prefixedFlags: []string{"password-file"}},
+		{key: "credential_helper", value: p.CredentialHelper, flags: []string{"credential-helper"}, prefixedFlags: []string{"credential-helper"}},
+		{key: "datastore", value: p.DatastorePath, flags: []string{"datastore-path"}, prefixedFlags: []string{"datastore-path"}},
+		{key: "pool", value: p.PoolPath, flags: []string{"pool-path", "pool"}, prefixedFlags: []string{"pool-path"}},
+		{key: "host", value: p.HostPath, prefixedFlags: []string{"host-path"}},
+		{key: "network", value: p.NetworkPath, flags: []string{"network"}, prefixedFlags: []string{"network-name"}},
+		{key: "folder", value: p.FolderPath, flags: []string{"dest-folder-path", "image-folder-path"}, prefixedFlags: []string{"folder-path"}},
+		{key: "cluster", value: p.ClusterPath, prefixedFlags: []string{"cluster-path"}},
+	}
+}
+
+// profileFlags are the global flags for choosing a profile.
+var profileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		Usage:  "The config file with the vCenter profiles. Defaults to ~/.config/vsphere-images/config.yaml, or config.toml if that exists instead.",
+		EnvVar: "VSPHERE_IMAGES_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "profile",
+		Usage:  "The name of the vCenter profile in the config file to use for any flags that aren't given",
+		EnvVar: "VSPHERE_IMAGES_PROFILE",
+	},
+}
+
+// withProfiles wraps a command's action so that the profiles given with
+// --profile, --src-profile and --dest-profile are applied before it runs.
+func withProfiles(action interface{}) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := applyProfiles(c); err != nil {
+			return err
+		}
+
+		return action.(func(*cli.Context) error)(c)
+	}
+}
+
+func applyProfiles(c *cli.Context) error {
+	names := map[string]string{"": c.GlobalString("profile")}
+	if hasFlag(c, "src-profile") {
+		names["src-"] = c.String("src-profile")
+	}
+	if hasFlag(c, "dest-profile") {
+		names["dest-"] = c.String("dest-profile")
+	}
+
+	var config *profileConfig
+	for prefix, name := range names {
+		if name == "" {
+			continue
+		}
+
+		if config == nil {
+			var err error
+			config, err = readProfileConfig(c.GlobalString("config"))
+			if err != nil {
+				return err
+			}
+		}
+
+		p, ok := config.Profiles[name]
+		if !ok {
+			return errors.Errorf("unknown profile %q", name)
+		}
+
+		if err := applyProfile(c, name, p, prefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyProfile sets the flags of the command that aren't set yet to the
+// profile's values. prefix is "" for --profile, or the prefix of the flags the
+// profile is for.
+func applyProfile(c *cli.Context, name string, p profile, prefix string) error {
+	if prefix == "" && !hasFlag(c, "vsphere-url") {
+		return errors.Errorf("%s doesn't use --profile, use --src-profile and --dest-profile or the manifest instead", c.Command.Name)
+	}
+
+	for _, setting := range p.settings() {
+		if setting.value == "" {
+			continue
+		}
+
+		flags := setting.flags
+		if prefix != "" {
+			flags = nil
+			for _, flag := range setting.prefixedFlags {
+				flags = append(flags, prefix+flag)
+			}
+		}
+
+		found := false
+		for _, flag := range flags {
+			if !hasFlag(c, flag) {
+				continue
+			}
+			found = true
+
+			if c.IsSet(flag) {
+				continue
+			}
+			if err := c.Set(flag, setting.value); err != nil {
+				return errors.Wrapf(err, "using %s from profile %q failed", setting.key, name)
+			}
+		}
+
+		if setting.required && !found {
+			return errors.Errorf("profile %q sets %s, which %s doesn't support", name, setting.key, c.Command.Name)
+		}
+	}
+
+	return nil
+}
+
+func hasFlag(c *cli.Context, name string) bool {
+	for _, flag := range c.Command.Flags {
+		if flag.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readProfileConfig reads the config file at configPath, or the default one
+// if configPath is empty.
+func readProfileConfig(configPath string) (*profileConfig, error) {
+	if configPath == "" {
+		configPath = defaultProfileConfigPath()
+	}
+
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file failed")
+	}
+
+	var config profileConfig
+	switch filepath.Ext(configPath) {
+	case ".toml":
+		err = toml.Unmarshal(b, &config)
+	default:
+		err = yaml.Unmarshal(b, &config)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing config file failed")
+	}
+
+	return &config, nil
+}
+
+func defaultProfileConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+
+	configPath := filepath.Join(dir, "vsphere-images", "config.yaml")
+	tomlPath := filepath.Join(dir, "vsphere-images", "config.toml")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if _, err := os.Stat(tomlPath); err == nil {
+			return tomlPath
+		}
+	}
+
+	return configPath
+}
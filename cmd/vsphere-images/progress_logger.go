@@ -4,26 +4,87 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/vmware/govmomi/vim25/progress"
 )
 
+// progressFormat is how progress is printed: "tty" redraws the current line,
+// "plain" prints a line for every 10% and "json" prints a JSON object for
+// every report. It is set by the global --progress flag.
+var progressFormat = "tty"
+
+// progressSinker is a progress.Sinker that shows the steps of operations
+// that report them and the retries of steps, and has to be waited on once the
+// work it reports on is done, so that it's done printing.
+type progressSinker interface {
+	vsphereimages.StepSinker
+	Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error)
+	Wait()
+}
+
+// newProgressLogger returns a logger for work that runs one step at a time,
+// in the format given by progressFormat.
+func newProgressLogger(prefix string) progressSinker {
+	if planning {
+		return &quietProgressLogger{}
+	}
+
+	switch progressFormat {
+	case "plain":
+		p := newLineProgressLogger(prefix)
+		p.printResult = true
+		return p
+	case "json":
+		return newJSONProgressLogger(prefix)
+	}
+
+	return newTTYProgressLogger(prefix)
+}
+
+// newConcurrentProgressLogger returns a logger that can report on several
+// steps that run at the same time, in the format given by progressFormat.
+func newConcurrentProgressLogger(prefix string) progressSinker {
+	if planning {
+		return &quietProgressLogger{}
+	}
+
+	if progressFormat == "json" {
+		return newJSONProgressLogger(prefix)
+	}
+
+	return newLineProgressLogger(prefix)
+}
+
+// progressLogger redraws the current line as progress is reported, which only
+// looks right on a terminal.
 type progressLogger struct {
 	prefix string
 	wg     sync.WaitGroup
 
-	sink chan chan progress.Report
-	done chan struct{}
+	// stepLabel is the step the progress is for, if the operation reports
+	// steps. It is only used by the loop.
+	stepLabel string
+
+	sink    chan chan progress.Report
+	step    chan string
+	retry   chan string
+	done    chan struct{}
+	stopped chan struct{}
 }
 
-func newProgressLogger(prefix string) *progressLogger {
+func newTTYProgressLogger(prefix string) *progressLogger {
 	p := &progressLogger{
 		prefix: prefix,
 
-		sink: make(chan chan progress.Report),
-		done: make(chan struct{}),
+		sink:    make(chan chan progress.Report),
+		step:    make(chan string),
+		retry:   make(chan string),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
 	p.wg.Add(1)
@@ -37,6 +98,7 @@ func (p *progressLogger) loopA() {
 	var err error
 
 	defer p.wg.Done()
+	defer close(p.stopped)
 
 	tick := time.NewTicker(100 * time.Millisecond)
 	defer tick.Stop()
@@ -48,18 +110,31 @@ func (p *progressLogger) loopA() {
 			if err != nil {
 				stop = true
 			}
+		case step := <-p.step:
+			// every step after the first gets a line of its own, so that the
+			// earlier steps stay visible
+			if p.stepLabel != "" {
+				fmt.Fprintln(os.Stderr)
+			}
+			p.stepLabel = step
+		case retry := <-p.retry:
+			// the retry gets a line of its own, below the attempt that failed
+			fmt.Fprintf(os.Stderr, "\n%s%s\n", p.prefix, retry)
 		case <-p.done:
 			stop = true
 		case <-tick.C:
-			fmt.Fprintf(os.Stderr, "\r%s      ", p.prefix)
+			fmt.Fprintf(os.Stderr, "\r%s%s      ", p.prefix, p.stepLabel)
 		}
 	}
 
 	if err != nil && err != io.EOF {
-		fmt.Fprintf(os.Stderr, "\r%s      ", p.prefix)
-		fmt.Fprintf(os.Stderr, "\r%sError: %s\n", p.prefix, err)
+		fmt.Fprintf(os.Stderr, "\r%s%s      ", p.prefix, p.stepLabel)
+		fmt.Fprintf(os.Stderr, "\r%s%sError: %s\n", p.prefix, p.stepLabel, err)
 	} else {
-		fmt.Fprintf(os.Stderr, "\r%s      ", p.prefix)
+		fmt.Fprintf(os.Stderr, "\r%s%s      ", p.prefix, p.stepLabel)
+		if p.stepLabel != "" {
+			fmt.Fprintln(os.Stderr)
+		}
 		fmt.Fprintf(os.Stderr, "\r%sOK\n", p.prefix)
 	}
 }
@@ -77,7 +152,7 @@ func (p *progressLogger) loopB(tick *time.Ticker, ch <-chan progress.Report) err
 			}
 			err = r.Error()
 		case <-tick.C:
-			line := "\r" + p.prefix
+			line := "\r" + p.prefix + p.stepLabel
 			if r != nil {
 				line += fmt.Sprintf("(%.0f%%", r.Percentage())
 				detail := r.Detail()
@@ -99,7 +174,108 @@ func (p *progressLogger) Sink() chan<- progress.Report {
 	return ch
 }
 
+// Step shows which step of the operation the progress is for, e.g.
+// "step 2/5: removing snapshots".
+func (p *progressLogger) Step(number int, total int, name string) {
+	select {
+	case p.step <- formatStep(number, total, name):
+	case <-p.stopped:
+	}
+}
+
+// Retry prints a line saying that the current step is tried again.
+func (p *progressLogger) Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+	select {
+	case p.retry <- formatRetry(name, attempt, maxAttempts, delay, err):
+	case <-p.stopped:
+	}
+}
+
 func (p *progressLogger) Wait() {
 	close(p.done)
 	p.wg.Wait()
 }
+
+// lineProgressLogger prints a line every time a task gets another 10% done.
+// Unlike progressLogger, it doesn't redraw the current line, so several of
+// them can report on tasks that run at the same time.
+type lineProgressLogger struct {
+	prefix string
+	wg     sync.WaitGroup
+
+	// printResult makes Wait print "OK" if no step failed.
+	printResult bool
+
+	mutex  sync.Mutex
+	failed bool
+}
+
+func newLineProgressLogger(prefix string) *lineProgressLogger {
+	return &lineProgressLogger{prefix: prefix}
+}
+
+func (p *lineProgressLogger) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	p.wg.Add(1)
+	go p.loop(ch)
+	return ch
+}
+
+func (p *lineProgressLogger) loop(ch <-chan progress.Report) {
+	defer p.wg.Done()
+
+	var err error
+	step := -1
+	for r := range ch {
+		if r.Error() != nil {
+			err = r.Error()
+			continue
+		}
+
+		if s := int(r.Percentage()) / 10; s > step {
+			step = s
+			fmt.Fprintf(os.Stderr, "%s%.0f%%\n", p.prefix, r.Percentage())
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sError: %s\n", p.prefix, err)
+
+		p.mutex.Lock()
+		p.failed = true
+		p.mutex.Unlock()
+	}
+}
+
+// Step prints a line saying which step of the operation is starting, once the
+// earlier steps are done printing.
+func (p *lineProgressLogger) Step(number int, total int, name string) {
+	p.wg.Wait()
+	fmt.Fprintf(os.Stderr, "%s%s\n", p.prefix, strings.TrimSpace(formatStep(number, total, name)))
+}
+
+// Retry prints a line saying that a step is tried again, once the earlier
+// attempt is done printing.
+func (p *lineProgressLogger) Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+	p.wg.Wait()
+	fmt.Fprintf(os.Stderr, "%s%s\n", p.prefix, formatRetry(name, attempt, maxAttempts, delay, err))
+}
+
+func (p *lineProgressLogger) Wait() {
+	p.wg.Wait()
+
+	if p.printResult && !p.failed {
+		fmt.Fprintf(os.Stderr, "%sOK\n", p.prefix)
+	}
+}
+
+// formatStep formats a step reported by a vsphereimages.StepSinker to show
+// before the progress of the step.
+func formatStep(number int, total int, name string) string {
+	return fmt.Sprintf("step %d/%d: %s ", number, total, name)
+}
+
+// formatRetry formats a retry reported by a vsphereimages.RetrySinker.
+func formatRetry(name string, attempt int, maxAttempts int, delay time.Duration, err error) string {
+	return fmt.Sprintf("%s failed (%v), retrying in %s (attempt %d/%d)", name, err, delay, attempt, maxAttempts)
+}
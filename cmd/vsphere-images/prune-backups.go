@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+var pruneBackupsCommand = cli.Command{
+	Name:      "prune-backups",
+	Usage:     "destroy backups that aren't kept by a retention policy",
+	ArgsUsage: "backup-folder-path",
+	Action:    pruneBackupsAction,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "vsphere-url",
+			Usage:  "URL to the vSphere SDK API",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_URL",
+		},
+		cli.BoolFlag{
+			Name:   "vsphere-insecure-skip-verify",
+			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:  "image-folder-path",
+			Usage: "The inventory path to the folder with the current images. Backups that these images were restored from are never destroyed.",
+		},
+		cli.IntFlag{
+			Name:  "keep-last",
+			Usage: "Number of most recent backups of each image to keep",
+			Value: 3,
+		},
+		cli.IntFlag{
+			Name:  "keep-daily-days",
+			Usage: "Number of days to keep the most recent backup of each day for",
+		},
+		cli.IntFlag{
+			Name:  "keep-weekly-days",
+			Usage: "Number of days to keep the most recent backup of each week for",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "If enabled, only prints which backups would be kept and destroyed",
+		},
+	}, append(vSphereTLSFlags, credentialFlags("")...)...),
+}
+
+func pruneBackupsAction(c *cli.Context) error {
+	vSphereStringURL := c.String("vsphere-url")
+	if vSphereStringURL == "" {
+		return errors.New("the 'vsphere-url' flag is required")
+	}
+
+	vSphereURL, err := url.Parse(vSphereStringURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing vSphere URL failed")
+	}
+
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
+	backupFolderPath := c.Args().Get(0)
+	if backupFolderPath == "" {
+		return errors.New("backup folder inventory path is required")
+	}
+
+	imageFolderPath := c.String("image-folder-path")
+	if imageFolderPath == "" {
+		return errors.New("the 'image-folder-path' flag is required")
+	}
+
+	policy := vsphereimages.RetentionPolicy{
+		KeepLast:      c.Int("keep-last"),
+		KeepDailyFor:  time.Duration(c.Int("keep-daily-days")) * 24 * time.Hour,
+		KeepWeeklyFor: time.Duration(c.Int("keep-weekly-days")) * 24 * time.Hour,
+	}
+
+	dryRun := c.Bool("dry-run")
+
+	ctx := commandCtx
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger("Pruning backups… ")
+	decisions, err := client.PruneBackups(ctx, backupFolderPath, imageFolderPath, policy, dryRun, logger)
+	if err != nil {
+		return errors.Wrap(err, "pruning backups failed")
+	}
+	logger.Wait()
+
+	destroyed := "destroy"
+	if !dryRun {
+		destroyed = "destroyed"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, decision := range decisions {
+		if decision.Keep {
+			fmt.Fprintf(w, "keep\t%s\t%s\n", decision.Path, decision.Reason)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t\n", destroyed, decision.Path)
+		}
+	}
+
+	return w.Flush()
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"context"
 	"net/url"
 
 	"github.com/pkg/errors"
-	vsphereimages "github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -14,7 +12,7 @@ var resnapshotCommand = cli.Command{
 	Usage:     "Remove (if it exists) and add a new 'base' snapshot to an image",
 	ArgsUsage: "image-inventory-path",
 	Action:    resnapshotAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -25,7 +23,7 @@ var resnapshotCommand = cli.Command{
 			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
 			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
 		},
-	},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func resnapshotAction(c *cli.Context) error {
@@ -39,18 +37,32 @@ func resnapshotAction(c *cli.Context) error {
 		return errors.Wrap(err, "parsing vSphere URL failed")
 	}
 
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
 	imagePath := c.Args().Get(0)
 	if imagePath == "" {
 		return errors.New("image inventory path is required")
 	}
 
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
 	logger := newProgressLogger("Snapshotting image… ")
-	err = vsphereimages.SnapshotImage(ctx, vSphereURL, c.Bool("vsphere-insecure-skip-verify"), imagePath, logger)
+	err = client.SnapshotImage(ctx, imagePath, logger)
 	if err != nil {
 		return errors.Wrap(err, "snapshotting image failed")
 	}
 	logger.Wait()
 
-	return nil
+	return printPlan(c, "Snapshotting "+imagePath, plan)
 }
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"context"
 	"net/url"
 
 	"github.com/pkg/errors"
-	"github.com/travis-ci/vsphere-images"
 	"github.com/urfave/cli"
 )
 
@@ -14,7 +12,7 @@ var restoreBackupCommand = cli.Command{
 	Usage:     "restore an image from a backup clone",
 	ArgsUsage: "image-path",
 	Action:    restoreBackupAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "vsphere-url",
 			Usage:  "URL to the vSphere SDK API",
@@ -39,28 +37,46 @@ var restoreBackupCommand = cli.Command{
 			Name:  "dest-folder-path",
 			Usage: "The inventory path to the folder the VM should be restored to",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "force-clean",
+			Usage: "Destroy leftover \"-restoring\" and \"-old\" VMs instead of resuming an interrupted restore",
+		},
+		cloneTimeoutFlag,
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
 }
 
 func restoreBackupAction(c *cli.Context) error {
-	ctx := context.Background()
+	ctx, plan, err := planContext(c)
+	if err != nil {
+		return err
+	}
 
 	vSphereURL, err := url.Parse(c.String("vsphere-url"))
 	if err != nil {
 		return errors.Wrap(err, "parsing source URL failed")
 	}
 
-	insecure := c.Bool("vsphere-insecure-skip-verify")
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+
 	sourceImagePath := c.Args().Get(0)
 	destFolderPath := c.String("dest-folder-path")
 	datastorePath := c.String("datastore-path")
 	poolPath := c.String("pool-path")
 
 	logger := newProgressLogger("Restoring backup image… ")
-	if err = vsphereimages.RestoreBackup(ctx, vSphereURL, insecure, sourceImagePath, destFolderPath, datastorePath, poolPath, logger); err != nil {
+	if err = client.RestoreBackup(ctx, sourceImagePath, destFolderPath, datastorePath, poolPath, c.Bool("force-clean"), backupOptions(c), logger); err != nil {
 		return errors.Wrap(err, "restoring backup image failed")
 	}
 
 	logger.Wait()
-	return nil
+	return printPlan(c, "Restoring "+sourceImagePath, plan)
 }
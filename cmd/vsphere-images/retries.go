@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+// retryFlags are the global flags for how steps that fail because of a
+// transient vSphere fault are retried.
+var retryFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:   "retries",
+		Value:  vsphereimages.DefaultRetryPolicy.MaxAttempts - 1,
+		Usage:  "How many times to retry a step that fails because of a transient fault, such as TaskInProgress or a 503 from vCenter",
+		EnvVar: "VSPHERE_IMAGES_RETRIES",
+	},
+	cli.DurationFlag{
+		Name:   "retry-delay",
+		Value:  vsphereimages.DefaultRetryPolicy.InitialDelay,
+		Usage:  "How long to wait before the first retry. Every retry after that waits twice as long as the one before, up to a minute.",
+		EnvVar: "VSPHERE_IMAGES_RETRY_DELAY",
+	},
+}
+
+// applyRetryPolicy makes the vSphere clients created by the command retry
+// steps as the --retries and --retry-delay flags say.
+func applyRetryPolicy(c *cli.Context) error {
+	retries := c.GlobalInt("retries")
+	if retries < 0 {
+		return errors.New("--retries can't be negative")
+	}
+
+	vsphereimages.DefaultRetryPolicy.MaxAttempts = retries + 1
+	vsphereimages.DefaultRetryPolicy.InitialDelay = c.GlobalDuration("retry-delay")
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+var rollbackImageCommand = cli.Command{
+	Name:      "rollback-image",
+	Usage:     "swap an image with its \"-old\" image, or clean up old images",
+	ArgsUsage: "image-path|folder-path",
+	Action:    rollbackImageAction,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "vsphere-url",
+			Usage:  "URL to the vSphere SDK API",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_URL",
+		},
+		cli.BoolFlag{
+			Name:   "vsphere-insecure-skip-verify",
+			Usage:  "Whether the vCenter's certificate chain and hostname should be verified",
+			EnvVar: "VSPHERE_IMAGES_VSPHERE_INSECURE_SKIP_VERIFY",
+		},
+		cli.BoolFlag{
+			Name:  "cleanup-old",
+			Usage: "Instead of rolling back an image, destroy the \"-old\" images in the given folder",
+		},
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "With --cleanup-old, only destroy images that haven't been modified for this long",
+			Value: 7 * 24 * time.Hour,
+		},
+	}, append(append(vSphereTLSFlags, dryRunFlags...), credentialFlags("")...)...),
+}
+
+func rollbackImageAction(c *cli.Context) error {
+	vSphereStringURL := c.String("vsphere-url")
+	if vSphereStringURL == "" {
+		return errors.New("the 'vsphere-url' flag is required")
+	}
+
+	vSphereURL, err := url.Parse(vSphereStringURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing vSphere URL failed")
+	}
+
+	vSphereURL, err = withCredentials(c, "", vSphereURL)
+	if err != nil {
+		return err
+	}
+
+	inventoryPath := c.Args().Get(0)
+	if inventoryPath == "" {
+		return errors.New("image or folder inventory path is required")
+	}
+
+	ctx := commandCtx
+	var plan *vsphereimages.Plan
+	if !c.Bool("cleanup-old") {
+		// with --cleanup-old, --dry-run prints the images that would be
+		// destroyed instead
+		ctx, plan, err = planContext(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err := newVSphereClient(ctx, c, vSphereURL)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+
+	if c.Bool("cleanup-old") {
+		logger := newProgressLogger("Cleaning up old images… ")
+		destroyed, err := client.CleanupOldImages(ctx, inventoryPath, c.Duration("older-than"), c.Bool("dry-run"), logger)
+		if err != nil {
+			return errors.Wrap(err, "cleaning up old images failed")
+		}
+		logger.Wait()
+
+		for _, info := range destroyed {
+			fmt.Println(info.InventoryPath)
+		}
+
+		return nil
+	}
+
+	logger := newProgressLogger("Rolling back image… ")
+	if err = client.RollbackImage(ctx, inventoryPath, logger); err != nil {
+		return errors.Wrap(err, "rolling back image failed")
+	}
+	logger.Wait()
+
+	return printPlan(c, "Rolling back "+inventoryPath, plan)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit code when the command was interrupted, which
+// is the code shells use for processes killed by SIGINT.
+const exitInterrupted = 130
+
+// commandCtx is the context commands do everything with. It is cancelled when
+// the process is interrupted, which cancels any running vSphere tasks and
+// rolls back the operation that was running, if it can be.
+var commandCtx, cancelCommand = context.WithCancel(context.Background())
+
+// handleSignals cancels commandCtx on the first SIGINT or SIGTERM, and exits
+// right away on the second one.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "\nReceived %s, cancelling running tasks (send it again to exit right away)\n", sig)
+		cancelCommand()
+
+		<-signals
+		os.Exit(exitInterrupted)
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+// exitTimedOut is the exit code when the command or one of its steps timed
+// out, which is the code timeout(1) uses.
+const exitTimedOut = 124
+
+// commandTimeout is how long the whole command may take, or 0 for no limit.
+var commandTimeout time.Duration
+
+// timeoutFlag is the global flag that limits how long the command may take.
+var timeoutFlag = cli.DurationFlag{
+	Name:   "timeout",
+	Usage:  "How long the command may take, e.g. 2h. Running tasks are cancelled and rolled back once it is up. Defaults to no limit.",
+	EnvVar: "VSPHERE_IMAGES_TIMEOUT",
+}
+
+// applyTimeout makes commandCtx expire once the --timeout is up.
+func applyTimeout(c *cli.Context) {
+	commandTimeout = c.GlobalDuration("timeout")
+	if commandTimeout > 0 {
+		commandCtx, cancelCommand = context.WithTimeout(commandCtx, commandTimeout)
+	}
+}
+
+// timedOut returns whether err is because the command or one of its steps
+// took too long.
+func timedOut(err error) bool {
+	if commandCtx.Err() == context.DeadlineExceeded {
+		return true
+	}
+
+	_, ok := errors.Cause(err).(*vsphereimages.TimeoutError)
+	return ok
+}
+
+// cloneTimeoutFlag limits how long a clone may take, for the commands that
+// clone VMs.
+var cloneTimeoutFlag = cli.DurationFlag{
+	Name:   "clone-timeout",
+	Usage:  "How long cloning the VM may take before it is cancelled and rolled back. Defaults to no limit.",
+	EnvVar: "VSPHERE_IMAGES_CLONE_TIMEOUT",
+}
+
+func backupOptions(c *cli.Context) vsphereimages.BackupOptions {
+	return vsphereimages.BackupOptions{
+		CloneTimeout: c.Duration("clone-timeout"),
+	}
+}
+
+// checkOutTimeoutFlags limit how long the steps of checkout-host and
+// checkin-host may take.
+var checkOutTimeoutFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:   "maintenance-timeout",
+		Usage:  "How long entering or exiting maintenance mode may take before the check-out is cancelled and rolled back. Defaults to no limit.",
+		EnvVar: "VSPHERE_IMAGES_MAINTENANCE_TIMEOUT",
+	},
+	cli.DurationFlag{
+		Name:   "move-timeout",
+		Usage:  "How long moving the host to the destination cluster may take before the check-out is cancelled and rolled back. Defaults to no limit.",
+		EnvVar: "VSPHERE_IMAGES_MOVE_TIMEOUT",
+	},
+}
+
+func checkOutOptions(c *cli.Context) vsphereimages.CheckOutOptions {
+	return vsphereimages.CheckOutOptions{
+		MaintenanceTimeout: c.Duration("maintenance-timeout"),
+		MoveTimeout:        c.Duration("move-timeout"),
+	}
+}
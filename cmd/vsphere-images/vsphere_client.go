@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/pkg/errors"
+	vsphereimages "github.com/travis-ci/vsphere-images"
+	"github.com/urfave/cli"
+)
+
+// vSphereTLSFlags are the flags for verifying the certificate of the vCenter
+// given with --vsphere-url, besides --vsphere-insecure-skip-verify.
+var vSphereTLSFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "vsphere-ca-file",
+		Usage:  "A PEM file with the CA certificates to trust for the vCenter, instead of the system's",
+		EnvVar: "VSPHERE_IMAGES_VSPHERE_CA_FILE",
+	},
+	cli.StringFlag{
+		Name:   "vsphere-sha256-fingerprint",
+		Usage:  "Only accept a certificate with this SHA-256 fingerprint from the vCenter. Format should be :-separated hexadecimal numbers.",
+		EnvVar: "VSPHERE_IMAGES_VSPHERE_SHA256_FINGERPRINT",
+	},
+}
+
+// newVSphereClient connects to the vCenter at u, verifying its certificate as
+// --vsphere-insecure-skip-verify and vSphereTLSFlags say. The caller should
+// log out once it is done with the client.
+func newVSphereClient(ctx context.Context, c *cli.Context, u *url.URL) (*vsphereimages.Client, error) {
+	client, err := vsphereimages.NewClientWithTLS(ctx, u, vsphereimages.TLSOptions{
+		InsecureSkipVerify: c.Bool("vsphere-insecure-skip-verify"),
+		CAFile:             c.String("vsphere-ca-file"),
+		SHA256Fingerprint:  c.String("vsphere-sha256-fingerprint"),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating vSphere client failed")
+	}
+
+	return client, nil
+}
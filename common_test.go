@@ -2,6 +2,7 @@ package vsphereimages
 
 import (
 	"context"
+	"crypto/tls"
 	"net/url"
 	"sync"
 
@@ -90,12 +91,25 @@ type SimulatedService struct {
 }
 
 func StartService() (*SimulatedService, error) {
+	return startService(false)
+}
+
+// StartTLSService is like StartService, but the simulator serves HTTPS with
+// a self-signed certificate for 127.0.0.1.
+func StartTLSService() (*SimulatedService, error) {
+	return startService(true)
+}
+
+func startService(useTLS bool) (*SimulatedService, error) {
 	model := simulator.VPX()
 	model.Machine = 4
 	model.ClusterHost = 6
 	if err := model.Create(); err != nil {
 		return nil, err
 	}
+	if useTLS {
+		model.Service.TLS = new(tls.Config)
+	}
 	s := model.Service.NewServer()
 
 	service := &SimulatedService{
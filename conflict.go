@@ -0,0 +1,154 @@
+package vsphereimages
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// ConflictPolicy controls what CopyImage does when the destination VM
+// already exists.
+type ConflictPolicy string
+
+const (
+	// ConflictFail makes the copy fail. This is the default.
+	ConflictFail ConflictPolicy = "fail"
+
+	// ConflictSkip leaves the existing VM alone and doesn't copy anything.
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictReplace copies the VM under a temporary name, and then swaps it
+	// in, renaming the existing VM with the "-old" suffix. The existing VM is
+	// only touched once the copy has finished.
+	ConflictReplace ConflictPolicy = "replace"
+
+	// ConflictRenameOld renames the existing VM with the "-old" suffix before
+	// copying. It needs less room than ConflictReplace, but the VM is missing
+	// while it's being copied.
+	ConflictRenameOld ConflictPolicy = "rename-old"
+)
+
+// replacingImageSuffix is appended to the name of a VM while it is being
+// copied with ConflictReplace.
+const replacingImageSuffix = "-replacing"
+
+// ParseConflictPolicy returns the ConflictPolicy with the given name. An
+// empty name is ConflictFail.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case "":
+		return ConflictFail, nil
+	case ConflictFail, ConflictSkip, ConflictReplace, ConflictRenameOld:
+		return policy, nil
+	}
+
+	return "", errors.Errorf("unknown conflict policy %q, must be one of fail, skip, replace or rename-old", name)
+}
+
+// copyConflict is what a copy has to do about a VM that already exists with
+// the destination name.
+type copyConflict struct {
+	// existing is the VM that already exists, or nil if there is none.
+	existing *object.VirtualMachine
+
+	// skip is true if nothing should be copied.
+	skip bool
+
+	// cloneName is the name to clone the VM to.
+	cloneName string
+}
+
+// checkConflict finds out whether a VM named name already exists in the folder,
+// and what to do about it according to the policy. An error is returned if
+// the policy doesn't allow the copy to go ahead, or if a VM that the policy
+// needs to create is in the way.
+func (c *Client) checkConflict(ctx context.Context, folderPath string, name string, policy ConflictPolicy) (copyConflict, error) {
+	conflict := copyConflict{cloneName: name}
+
+	imagePath := path.Join(folderPath, name)
+	existing, err := c.findImageIfExists(ctx, imagePath)
+	if err != nil {
+		return conflict, errors.Wrap(err, "checking whether the destination VM exists failed")
+	}
+	if existing == nil {
+		return conflict, nil
+	}
+	conflict.existing = existing
+
+	switch policy {
+	case ConflictSkip:
+		conflict.skip = true
+		return conflict, nil
+	case ConflictReplace:
+		conflict.cloneName = name + replacingImageSuffix
+	case ConflictRenameOld:
+	default:
+		return conflict, &AlreadyExistsError{Path: imagePath}
+	}
+
+	for _, inTheWay := range []string{imagePath + oldImageSuffix, path.Join(folderPath, conflict.cloneName)} {
+		if inTheWay == imagePath {
+			continue
+		}
+
+		vm, err := c.findImageIfExists(ctx, inTheWay)
+		if err != nil {
+			return conflict, errors.Wrapf(err, "checking whether %s exists failed", inTheWay)
+		}
+		if vm != nil {
+			return conflict, &AlreadyExistsError{Path: inTheWay, Hint: "remove it first"}
+		}
+	}
+
+	return conflict, nil
+}
+
+// beforeClone renames the existing VM out of the way if the policy is
+// ConflictRenameOld, recording how to undo it in t.
+func (c *Client) beforeClone(ctx context.Context, t *transaction, conflict copyConflict, name string, policy ConflictPolicy, s progress.Sinker) error {
+	if conflict.existing == nil || policy != ConflictRenameOld {
+		return nil
+	}
+
+	if err := c.renameImage(ctx, conflict.existing, name+oldImageSuffix, s); err != nil {
+		return errors.Wrap(err, "renaming existing VM failed")
+	}
+
+	existing := conflict.existing
+	t.done("renaming "+name+" to "+name+oldImageSuffix, func(ctx context.Context) error {
+		return c.renameImage(ctx, existing, name, nil)
+	})
+
+	return nil
+}
+
+// afterClone swaps the copied VM in for the existing VM if the policy is
+// ConflictReplace, recording how to undo it in t.
+func (c *Client) afterClone(ctx context.Context, t *transaction, conflict copyConflict, folderPath string, name string, s progress.Sinker) error {
+	if conflict.cloneName == name {
+		return nil
+	}
+
+	cloned, err := c.findCreatedImage(ctx, path.Join(folderPath, conflict.cloneName))
+	if err != nil {
+		return errors.Wrap(err, "finding the copied VM failed")
+	}
+
+	if err = c.renameImage(ctx, conflict.existing, name+oldImageSuffix, s); err != nil {
+		return errors.Wrap(err, "renaming existing VM failed")
+	}
+
+	existing := conflict.existing
+	t.done("renaming "+name+" to "+name+oldImageSuffix, func(ctx context.Context) error {
+		return c.renameImage(ctx, existing, name, nil)
+	})
+
+	if err = c.renameImage(ctx, cloned, name, s); err != nil {
+		return errors.Wrap(err, "renaming copied VM failed")
+	}
+
+	return nil
+}
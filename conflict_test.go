@@ -0,0 +1,137 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCopyImageOnConflict(t *testing.T) {
+	tests := []struct {
+		policy      ConflictPolicy
+		err         string
+		replaced    bool
+		oldImageSet bool
+	}{
+		{policy: "", err: "/DC0/vm/published already exists"},
+		{policy: ConflictFail, err: "/DC0/vm/published already exists"},
+		{policy: ConflictSkip},
+		{policy: ConflictReplace, replaced: true, oldImageSet: true},
+		{policy: ConflictRenameOld, replaced: true, oldImageSet: true},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			service, err := StartService()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer service.Stop()
+
+			ctx := context.TODO()
+			finder, err := service.NewFinder(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the simulator keeps a VM's files where they are when it's
+			// renamed, so the existing VM is made under a different name to
+			// keep its files out of the way of the copy, like vCenter does
+			source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+			destination := simulatorCopyDestination(service, "published-files")
+			if err = CopyImage(ctx, source, destination, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := NewClient(ctx, service.URL(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Logout(ctx)
+
+			existing, err := client.finder.VirtualMachine(ctx, "/DC0/vm/published-files")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = client.renameImage(ctx, existing, "published", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			destination.VMName = "published"
+			destination.OnConflict = test.policy
+
+			err = CopyImage(ctx, source, destination, nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image, err := finder.VirtualMachine(ctx, "/DC0/vm/published")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := image.Reference() != existing.Reference(); replaced != test.replaced {
+				t.Errorf("expected replaced to be %t, got %t", test.replaced, replaced)
+			}
+
+			oldImage, err := finder.VirtualMachine(ctx, "/DC0/vm/published-old")
+			if test.oldImageSet {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if oldImage.Reference() != existing.Reference() {
+					t.Error("expected the existing VM to be renamed to published-old")
+				}
+			} else if err == nil {
+				t.Error("expected no published-old VM")
+			}
+
+			if _, err = finder.VirtualMachine(ctx, "/DC0/vm/published-replacing"); err == nil {
+				t.Error("expected the temporary VM to be gone")
+			}
+		})
+	}
+}
+
+func TestCopyImageReplaceWithOldImageInTheWay(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	destination := simulatorCopyDestination(service, "DC0_H0_VM1-old")
+	if err = CopyImage(ctx, source, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	destination.VMName = "DC0_H0_VM1"
+	destination.OnConflict = ConflictReplace
+	err = CopyImage(ctx, source, destination, nil)
+	if err == nil || !strings.Contains(err.Error(), "/DC0/vm/DC0_H0_VM1-old already exists, remove it first") {
+		t.Fatalf("expected error about the old VM, got %v", err)
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy("")
+	if err != nil || policy != ConflictFail {
+		t.Errorf("expected empty policy to be %q, got %q (%v)", ConflictFail, policy, err)
+	}
+
+	policy, err = ParseConflictPolicy("rename-old")
+	if err != nil || policy != ConflictRenameOld {
+		t.Errorf("expected %q, got %q (%v)", ConflictRenameOld, policy, err)
+	}
+
+	if _, err = ParseConflictPolicy("overwrite"); err == nil {
+		t.Error("expected error parsing unknown policy, but none occurred")
+	}
+}
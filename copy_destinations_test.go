@@ -0,0 +1,76 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCopyImageToDestinations(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	var destinations []ImageDestination
+	for _, folderPath := range []string{"/DC0/vm", "/DC0/vm", "/DC0/vm/nonexistent"} {
+		destinations = append(destinations, ImageDestination{
+			VSphereEndpoint:        service.URL(),
+			VSphereSHA1Fingerprint: "00:11:22:33",
+			FolderPath:             folderPath,
+			DatastorePath:          "/DC0/datastore/LocalDS_0",
+			ResourcePoolPath:       "/DC0/host/DC0_C0/Resources",
+			HostPath:               "/DC0/host/DC0_C0/DC0_C0_H0",
+			NetworkPath:            "/DC0/network/VM Network",
+		})
+	}
+	destinations[0].VMName = "copy-1"
+	destinations[1].VMName = "copy-2"
+	destinations[2].VMName = "copy-3"
+
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	errs := CopyImageToDestinations(ctx, source, destinations, nil)
+	if len(errs) != len(destinations) {
+		t.Fatalf("expected %d errors, got %d", len(destinations), len(errs))
+	}
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("expected first two copies to succeed, got %v and %v", errs[0], errs[1])
+	}
+	if errs[2] == nil || !strings.Contains(errs[2].Error(), "finding the destination folder failed") {
+		t.Fatalf("expected copy to nonexistent folder to fail, got %v", errs[2])
+	}
+
+	finder, err := service.NewFinder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vmPath := range []string{"/DC0/vm/copy-1", "/DC0/vm/copy-2"} {
+		if _, err = finder.VirtualMachine(ctx, vmPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopyImageToDestinationsMissingSource(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	destinations := []ImageDestination{
+		{VSphereEndpoint: service.URL(), FolderPath: "/DC0/vm", VMName: "copy-1"},
+		{VSphereEndpoint: service.URL(), FolderPath: "/DC0/vm", VMName: "copy-2"},
+	}
+
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/nonexistent"}
+	for i, err := range CopyImageToDestinations(ctx, source, destinations, nil) {
+		if err == nil || !strings.Contains(err.Error(), "finding the source VM failed") {
+			t.Fatalf("expected copy %d to fail finding the source VM, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vsphereimages
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialOptions say where to get the credentials for a vSphere API
+// endpoint from, so that they don't have to be part of the endpoint URL.
+// Credentials that are in the URL are still used for anything that isn't
+// set here.
+type CredentialOptions struct {
+	// Username is the username to log in with.
+	Username string
+
+	// Password is the password to log in with. It takes precedence over
+	// PasswordFile and Helper.
+	Password string
+
+	// PasswordFile is the path to a file containing the password to log in
+	// with. A trailing newline is ignored. It takes precedence over Helper.
+	PasswordFile string
+
+	// Helper is a command that prints the credentials, which is run by the
+	// shell. It works like a git credential helper: "get" is appended to the
+	// command, the protocol, host and username (if known) are written to its
+	// standard input as key=value lines, and it should print the username and
+	// password the same way.
+	Helper string
+}
+
+// WithCredentials returns a copy of vSphereEndpoint with the credentials
+// described by o. The endpoint itself isn't changed.
+func (o CredentialOptions) WithCredentials(ctx context.Context, vSphereEndpoint *url.URL) (*url.URL, error) {
+	endpoint := *vSphereEndpoint
+
+	var username, password string
+	var passwordSet bool
+	if endpoint.User != nil {
+		username = endpoint.User.Username()
+		password, passwordSet = endpoint.User.Password()
+	}
+
+	if o.Username != "" {
+		username = o.Username
+	}
+
+	switch {
+	case o.Password != "":
+		password, passwordSet = o.Password, true
+	case o.PasswordFile != "":
+		b, err := ioutil.ReadFile(o.PasswordFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading password file failed")
+		}
+		password, passwordSet = strings.TrimRight(string(b), "\r\n"), true
+	case o.Helper != "":
+		helperUsername, helperPassword, err := runCredentialHelper(ctx, o.Helper, &endpoint, username)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting credentials from the credential helper failed")
+		}
+		if username == "" {
+			username = helperUsername
+		}
+		password, passwordSet = helperPassword, true
+	}
+
+	switch {
+	case passwordSet:
+		endpoint.User = url.UserPassword(username, password)
+	case username != "":
+		endpoint.User = url.User(username)
+	}
+
+	return &endpoint, nil
+}
+
+// runCredentialHelper runs helper to get the credentials for endpoint, and
+// returns the username and password it printed.
+func runCredentialHelper(ctx context.Context, helper string, endpoint *url.URL, username string) (string, string, error) {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "protocol=%s\n", endpoint.Scheme)
+	fmt.Fprintf(&input, "host=%s\n", endpoint.Host)
+	if username != "" {
+		fmt.Fprintf(&input, "username=%s\n", username)
+	}
+	input.WriteString("\n")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", helper+" get")
+	cmd.Stdin = &input
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", "", errors.Wrap(err, msg)
+		}
+		return "", "", err
+	}
+
+	var helperUsername, password string
+	var passwordSet bool
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "username":
+			helperUsername = parts[1]
+		case "password":
+			password, passwordSet = parts[1], true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	if !passwordSet {
+		return "", "", errors.New("the credential helper didn't print a password")
+	}
+
+	return helperUsername, password, nil
+}
+
+// credentials returns the username and password the client logged in with,
+// so that they can be passed on to vCenter for cross-vCenter operations.
+func (c *Client) credentials() (string, string, error) {
+	if c.endpoint.User == nil {
+		return "", "", errors.New("vSphere endpoint doesn't have username and password set")
+	}
+
+	password, passwordSet := c.endpoint.User.Password()
+	if !passwordSet {
+		return "", "", errors.New("vSphere endpoint doesn't have password set")
+	}
+
+	return c.endpoint.User.Username(), password, nil
+}
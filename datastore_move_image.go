@@ -6,23 +6,25 @@ import (
 	"net/url"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/progress"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// DatastoreMoveImage moves the files of an image from one path to another on
+// its datastore, by unregistering the VM and registering it again from its new
+// path. If moving the files or registering the VM fails, or the move is
+// cancelled, the files are moved back and the VM is registered again from its
+// old path.
 func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath, srcDatastorePath, dstDatastorePath string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
-
-	finder := find.NewFinder(client.Client, false)
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.DatastoreMoveImage(ctx, imageInventoryPath, srcDatastorePath, dstDatastorePath, s)
+	})
+}
 
-	vm, err := finder.VirtualMachine(ctx, imageInventoryPath)
+func (c *Client) DatastoreMoveImage(ctx context.Context, imageInventoryPath, srcDatastorePath, dstDatastorePath string, s progress.Sinker) error {
+	vm, err := c.finder.VirtualMachine(ctx, imageInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the VM failed")
 	}
@@ -38,13 +40,13 @@ func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereIn
 	}
 
 	var mds mo.Datastore
-	err = client.PropertyCollector().RetrieveOne(ctx, mvm.Datastore[0].Reference(), nil, &mds)
+	err = c.client.PropertyCollector().RetrieveOne(ctx, mvm.Datastore[0].Reference(), nil, &mds)
 	if err != nil {
 		return errors.Wrap(err, "getting information about datastore failed")
 	}
 
-	ds := object.NewDatastore(client.Client, mvm.Datastore[0])
-	e, err := finder.Element(ctx, mvm.Datastore[0])
+	ds := object.NewDatastore(c.client.Client, mvm.Datastore[0])
+	e, err := c.finder.Element(ctx, mvm.Datastore[0])
 	if err != nil {
 		return errors.Wrap(err, "looking up datastore path failed")
 	}
@@ -55,16 +57,23 @@ func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereIn
 		return errors.Wrap(err, "creating browser failed")
 	}
 
-	task, err := browser.SearchDatastore(ctx, ds.Path(srcDatastorePath), &types.HostDatastoreBrowserSearchSpec{
-		MatchPattern: []string{"*.vmx"},
-	})
-	if err != nil {
-		return errors.Wrap(err, "creating task to search for VM config file failed")
-	}
+	s = withSteps(s, 3)
 
-	taskInfo, err := task.WaitForResult(ctx, nil)
-	if err != nil {
+	nextStep(s, "finding the VM's config file")
+	var taskInfo *types.TaskInfo
+	err = c.retry(ctx, "finding the VM's config file", s, func(s progress.Sinker) error {
+		task, err := browser.SearchDatastore(ctx, ds.Path(srcDatastorePath), &types.HostDatastoreBrowserSearchSpec{
+			MatchPattern: []string{"*.vmx"},
+		})
+		if err != nil {
+			return errors.Wrap(err, "creating task to search for VM config file failed")
+		}
+
+		taskInfo, err = waitForTask(ctx, task, s)
 		return errors.Wrap(err, "searching for VM config file failed")
+	})
+	if err != nil {
+		return err
 	}
 
 	var results []types.HostDatastoreBrowserSearchResults
@@ -92,9 +101,9 @@ func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereIn
 	if mvm.Parent == nil {
 		return errors.New("expected VM to have a parent, but was nil")
 	}
-	folder := object.NewFolder(client.Client, *mvm.Parent)
+	folder := object.NewFolder(c.client.Client, *mvm.Parent)
 
-	mes, err := mo.Ancestors(ctx, client.Client, client.Client.ServiceContent.PropertyCollector, ds.Reference())
+	mes, err := mo.Ancestors(ctx, c.client.Client, c.client.Client.ServiceContent.PropertyCollector, ds.Reference())
 	if err != nil {
 		return errors.Wrap(err, "getting datastore's ancestors to find datacenter failed")
 	}
@@ -102,7 +111,7 @@ func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereIn
 	var dc *object.Datacenter
 	for _, me := range mes {
 		if me.Self.Type == "Datacenter" {
-			dc = object.NewDatacenter(client.Client, me.Self)
+			dc = object.NewDatacenter(c.client.Client, me.Self)
 			break
 		}
 	}
@@ -118,27 +127,58 @@ func DatastoreMoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereIn
 	src := ds.Path(srcDatastorePath)
 	dst := ds.Path(dstDatastorePath)
 
-	err = vm.Unregister(ctx)
-	if err != nil {
-		return errors.Wrap(err, "unregistering the VM failed")
+	registerVM := func(ctx context.Context, vmxPath string, s progress.Sinker) error {
+		task, err := folder.RegisterVM(ctx, vmxPath, "", false, pool, nil)
+		if err != nil {
+			return errors.Wrap(err, "creating task to register VM failed")
+		}
+
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "registering VM failed")
 	}
 
-	m := object.NewFileManager(client.Client)
-	task, err = m.MoveDatastoreFile(ctx, src, dc, dst, dc, false)
-	if err != nil {
-		return errors.Wrap(err, "creating task to move image files failed")
+	var t transaction
+
+	if !planned(ctx, Action{Step: "unregistering the VM", Method: "UnregisterVM", Object: vm.InventoryPath}) {
+		err = vm.Unregister(ctx)
+		if err != nil {
+			return errors.Wrap(err, "unregistering the VM failed")
+		}
+
+		t.done("unregistering the VM", func(ctx context.Context) error {
+			return registerVM(ctx, src+"/"+vmxFilename, nil)
+		})
 	}
 
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
+	nextStep(s, "moving the VM's files")
+	m := object.NewFileManager(c.client.Client)
+	moveFiles := func(ctx context.Context, src, dst string, s progress.Sinker) error {
+		task, err := m.MoveDatastoreFile(ctx, src, dc, dst, dc, false)
+		if err != nil {
+			return errors.Wrap(err, "creating task to move image files failed")
+		}
+
+		_, err = waitForTask(ctx, task, s)
 		return errors.Wrap(err, "moving image files in datastore failed")
 	}
+	err = c.runTask(ctx, Action{Step: "moving the VM's files", Method: "MoveDatastoreFile_Task", Object: src, Target: dst}, s, func(s progress.Sinker) error {
+		return moveFiles(ctx, src, dst, s)
+	})
+	if err != nil {
+		return t.rollback(ctx, err)
+	}
 
-	task, err = folder.RegisterVM(ctx, dst+"/"+vmxFilename, "", false, pool, nil)
+	t.done("moving the VM's files", func(ctx context.Context) error {
+		return moveFiles(ctx, dst, src, nil)
+	})
+
+	nextStep(s, "registering the VM")
+	err = c.runTask(ctx, Action{Step: "registering the VM", Method: "RegisterVM_Task", Object: dst + "/" + vmxFilename, Target: imageInventoryPath}, s, func(s progress.Sinker) error {
+		return registerVM(ctx, dst+"/"+vmxFilename, s)
+	})
 	if err != nil {
-		return errors.Wrap(err, "creating task to register VM failed")
+		return t.rollback(ctx, err)
 	}
 
-	_, err = task.WaitForResult(ctx, s)
-	return errors.Wrap(err, "registering VM failed")
+	return nil
 }
@@ -0,0 +1,56 @@
+package vsphereimages
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+)
+
+func TestDatastoreMoveImageRegistersVMAgainOnFailure(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	datacenter, err := client.finder.Datacenter(ctx, "/DC0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// moving the files fails if there is something in the way
+	m := object.NewFileManager(client.client.Client)
+	if err = m.MakeDirectory(ctx, "[LocalDS_0] moved", datacenter, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = powerOff(ctx, client, "/DC0/vm/DC0_H0_VM0"); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	err = client.DatastoreMoveImage(ctx, "/DC0/vm/DC0_H0_VM0", "DC0_H0_VM0", "moved", logger)
+	if err == nil {
+		t.Fatal("expected error moving image, but none occurred")
+	}
+	rollbackErr, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("expected a *RollbackError, got %T: %v", err, err)
+	}
+	if len(rollbackErr.NotRolledBack) > 0 {
+		t.Fatal(rollbackErr)
+	}
+
+	if _, err = client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0"); err != nil {
+		t.Fatalf("expected the VM to be registered again, got %v", err)
+	}
+}
@@ -5,24 +5,41 @@ import (
 	"math"
 	"net/url"
 	"regexp"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/progress"
 )
 
-func IsHostCheckedOut(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, destinationClusterPath string) (bool, error) {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return false, errors.Wrap(err, "creating vSphere client failed")
-	}
+// CheckOutOptions limit how long the steps of checking a host out or in may
+// take. A step that takes longer is cancelled, the check-out is rolled back,
+// and a *TimeoutError is returned. A timeout of 0 means no limit.
+type CheckOutOptions struct {
+	// MaintenanceTimeout limits how long entering or exiting maintenance mode
+	// may take. Entering maintenance mode waits for every VM on the host to
+	// be powered off or migrated, which can take hours.
+	MaintenanceTimeout time.Duration
+
+	// MoveTimeout limits how long moving the host to the destination cluster
+	// may take.
+	MoveTimeout time.Duration
+}
 
-	finder := find.NewFinder(client.Client, false)
+func IsHostCheckedOut(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, destinationClusterPath string) (bool, error) {
+	var checkedOut bool
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		checkedOut, err = c.IsHostCheckedOut(ctx, destinationClusterPath)
+		return err
+	})
+	return checkedOut, err
+}
 
-	alreadyCheckedOut, err := hasCheckedOutHost(ctx, destinationClusterPath, finder)
+func (c *Client) IsHostCheckedOut(ctx context.Context, destinationClusterPath string) (bool, error) {
+	alreadyCheckedOut, err := hasCheckedOutHost(ctx, destinationClusterPath, c.finder)
 	if err != nil {
 		return false, errors.Wrap(err, "could not determine if a host was already checked out to destination cluster")
 	}
@@ -31,12 +48,17 @@ func IsHostCheckedOut(ctx context.Context, vSphereEndpoint *url.URL, vSphereInse
 }
 
 func SelectAvailableHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterInventoryPath string) (*object.HostSystem, error) {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating vSphere client failed")
-	}
+	var host *object.HostSystem
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		host, err = c.SelectAvailableHost(ctx, clusterInventoryPath)
+		return err
+	})
+	return host, err
+}
 
-	finder := find.NewFinder(client.Client, false)
+func (c *Client) SelectAvailableHost(ctx context.Context, clusterInventoryPath string) (*object.HostSystem, error) {
+	finder := c.finder
 
 	hosts, err := finder.HostSystemList(ctx, clusterInventoryPath)
 	if err != nil {
@@ -53,19 +75,26 @@ func SelectAvailableHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereI
 	}
 
 	if chosenHost == nil {
-		return nil, errors.New("no hosts available with only build VMs running")
+		return nil, &NoAvailableHostError{ClusterPath: clusterInventoryPath, Reason: "with only build VMs running"}
 	}
 
 	return chosenHost, err
 }
 
-func CheckOutSelectedHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, host *object.HostSystem, destinationClusterPath string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
+func CheckOutSelectedHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, host *object.HostSystem, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) error {
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.CheckOutSelectedHost(ctx, host, destinationClusterPath, options, s)
+	})
+}
 
-	finder := find.NewFinder(client.Client, false)
+func (c *Client) CheckOutSelectedHost(ctx context.Context, host *object.HostSystem, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) error {
+	finder := c.finder
+
+	// the host may have been found with a different client, so make sure
+	// that the tasks below are run with this client's session
+	inventoryPath := host.InventoryPath
+	host = object.NewHostSystem(c.client.Client, host.Reference())
+	host.InventoryPath = inventoryPath
 
 	alreadyCheckedOut, err := hasCheckedOutHost(ctx, destinationClusterPath, finder)
 	if err != nil {
@@ -73,7 +102,7 @@ func CheckOutSelectedHost(ctx context.Context, vSphereEndpoint *url.URL, vSphere
 	}
 
 	if alreadyCheckedOut {
-		return errors.New("a host is already checked out to the cluster at " + destinationClusterPath)
+		return &AlreadyCheckedOutError{ClusterPath: destinationClusterPath}
 	}
 
 	cluster, err := finder.ClusterComputeResource(ctx, destinationClusterPath)
@@ -81,54 +110,21 @@ func CheckOutSelectedHost(ctx context.Context, vSphereEndpoint *url.URL, vSphere
 		return errors.Wrap(err, "finding the destination cluster failed")
 	}
 
-	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, host)
-	if err != nil {
-		return errors.Wrap(err, "checking if host is in maintenance mode already failed")
-	}
-
-	// if the host is already in maintenance mode, skip this but still do the remaining work
-	if !inMaintenanceMode {
-		task, err := host.EnterMaintenanceMode(ctx, 0, true, nil)
-		if err != nil {
-			return errors.Wrap(err, "creating the enter maintenance mode task failed")
-		}
-
-		_, err = task.WaitForResult(ctx, s)
-		if err != nil {
-			return errors.Wrap(err, "moving the host into maintenance mode failed")
-		}
-	}
-
-	task, err := cluster.MoveInto(ctx, host)
-	if err != nil {
-		return errors.Wrap(err, "creating the move host task failed")
-	}
-
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return errors.Wrap(err, "moving host to destination cluster failed")
-	}
-
-	task, err = host.ExitMaintenanceMode(ctx, 0)
-	if err != nil {
-		return errors.Wrap(err, "creating the exit maintenance mode task failed")
-	}
-
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return errors.Wrap(err, "bringing the host out of maintenance mode failed")
-	}
-
-	return nil
+	return c.moveHost(ctx, host, cluster, options, s)
 }
 
-func CheckOutHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterInventoryPath string, destinationClusterPath string, s progress.Sinker) (*object.HostSystem, error) {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating vSphere client failed")
-	}
+func CheckOutHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterInventoryPath string, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) (*object.HostSystem, error) {
+	var host *object.HostSystem
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		host, err = c.CheckOutHost(ctx, clusterInventoryPath, destinationClusterPath, options, s)
+		return err
+	})
+	return host, err
+}
 
-	finder := find.NewFinder(client.Client, false)
+func (c *Client) CheckOutHost(ctx context.Context, clusterInventoryPath string, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) (*object.HostSystem, error) {
+	finder := c.finder
 
 	alreadyCheckedOut, err := hasCheckedOutHost(ctx, destinationClusterPath, finder)
 	if err != nil {
@@ -136,7 +132,7 @@ func CheckOutHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecure
 	}
 
 	if alreadyCheckedOut {
-		return nil, errors.New("a host is already checked out to the cluster at " + destinationClusterPath)
+		return nil, &AlreadyCheckedOutError{ClusterPath: destinationClusterPath}
 	}
 
 	hosts, err := finder.HostSystemList(ctx, clusterInventoryPath)
@@ -159,57 +155,28 @@ func CheckOutHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecure
 	}
 
 	if chosenHost == nil {
-		return nil, errors.New("no hosts available with only build VMs running")
+		return nil, &NoAvailableHostError{ClusterPath: clusterInventoryPath, Reason: "with only build VMs running"}
 	}
 
-	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, chosenHost)
-	if err != nil {
-		return nil, errors.Wrap(err, "checking if host is in maintenance mode already failed")
-	}
-
-	// if the host is already in maintenance mode, skip this but still do the remaining work
-	if !inMaintenanceMode {
-		task, err := chosenHost.EnterMaintenanceMode(ctx, 0, true, nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "creating the enter maintenance mode task failed")
-		}
-
-		_, err = task.WaitForResult(ctx, s)
-		if err != nil {
-			return nil, errors.Wrap(err, "moving the host into maintenance mode failed")
-		}
-	}
-
-	task, err := cluster.MoveInto(ctx, chosenHost)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating the move host task failed")
-	}
-
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return nil, errors.Wrap(err, "moving host to destination cluster failed")
-	}
-
-	task, err = chosenHost.ExitMaintenanceMode(ctx, 0)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating the exit maintenance mode task failed")
-	}
-
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return nil, errors.Wrap(err, "bringing the host out of maintenance mode failed")
+	if err = c.moveHost(ctx, chosenHost, cluster, options, s); err != nil {
+		return nil, err
 	}
 
 	return chosenHost, nil
 }
 
-func CheckInHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterInventoryPath string, destinationClusterPath string, s progress.Sinker) (*object.HostSystem, error) {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating vSphere client failed")
-	}
+func CheckInHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterInventoryPath string, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) (*object.HostSystem, error) {
+	var host *object.HostSystem
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		host, err = c.CheckInHost(ctx, clusterInventoryPath, destinationClusterPath, options, s)
+		return err
+	})
+	return host, err
+}
 
-	finder := find.NewFinder(client.Client, false)
+func (c *Client) CheckInHost(ctx context.Context, clusterInventoryPath string, destinationClusterPath string, options CheckOutOptions, s progress.Sinker) (*object.HostSystem, error) {
+	finder := c.finder
 
 	hosts, err := finder.HostSystemList(ctx, clusterInventoryPath)
 	if err != nil {
@@ -229,45 +196,81 @@ func CheckInHost(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureS
 		return nil, errors.Wrap(err, "finding the destination cluster failed")
 	}
 
-	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, hosts[0])
+	if err = c.moveHost(ctx, hosts[0], cluster, options, s); err != nil {
+		return nil, err
+	}
+
+	return hosts[0], nil
+}
+
+// moveHost moves host into cluster, putting it into maintenance mode while it
+// is moved. If the host can't be moved, a host that was put into maintenance
+// mode here is taken out of it again.
+func (c *Client) moveHost(ctx context.Context, host *object.HostSystem, cluster *object.ClusterComputeResource, options CheckOutOptions, s progress.Sinker) error {
+	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, host)
 	if err != nil {
-		return nil, errors.Wrap(err, "checking if host is in maintenance mode already failed")
+		return errors.Wrap(err, "checking if host is in maintenance mode already failed")
 	}
 
+	steps := 2
+	if !inMaintenanceMode {
+		steps++
+	}
+	s = withSteps(s, steps)
+
+	var t transaction
+
 	// if the host is already in maintenance mode, skip this but still do the remaining work
 	if !inMaintenanceMode {
-		task, err := hosts[0].EnterMaintenanceMode(ctx, 0, true, nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "creating the enter maintenance mode task failed")
-		}
+		nextStep(s, "entering maintenance mode")
+		err = c.runTask(ctx, Action{Step: "entering maintenance mode", Method: "EnterMaintenanceMode_Task", Object: host.InventoryPath}, s, func(s progress.Sinker) error {
+			task, err := host.EnterMaintenanceMode(ctx, 0, true, nil)
+			if err != nil {
+				return errors.Wrap(err, "creating the enter maintenance mode task failed")
+			}
 
-		_, err = task.WaitForResult(ctx, s)
+			_, err = waitForStep(ctx, task, "entering maintenance mode", options.MaintenanceTimeout, s)
+			return errors.Wrap(err, "moving the host into maintenance mode failed")
+		})
 		if err != nil {
-			return nil, errors.Wrap(err, "moving the host into maintenance mode failed")
+			return err
 		}
-	}
 
-	task, err := cluster.MoveInto(ctx, hosts[0])
-	if err != nil {
-		return nil, errors.Wrap(err, "creating the move host task failed")
+		t.done("entering maintenance mode", func(ctx context.Context) error {
+			return c.exitMaintenanceMode(ctx, host, options, nil)
+		})
 	}
 
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return nil, errors.Wrap(err, "moving host to destination cluster failed")
-	}
+	nextStep(s, "moving the host to the destination cluster")
+	err = c.runTask(ctx, Action{Step: "moving the host to the destination cluster", Method: "MoveInto_Task", Object: host.InventoryPath, Target: cluster.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := cluster.MoveInto(ctx, host)
+		if err != nil {
+			return errors.Wrap(err, "creating the move host task failed")
+		}
 
-	task, err = hosts[0].ExitMaintenanceMode(ctx, 0)
+		_, err = waitForStep(ctx, task, "moving the host to the destination cluster", options.MoveTimeout, s)
+		return errors.Wrap(err, "moving host to destination cluster failed")
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "creating the exit maintenance mode task failed")
+		return t.rollback(ctx, err)
 	}
 
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
-		return nil, errors.Wrap(err, "bringing the host out of maintenance mode failed")
-	}
+	// the host has been moved by now, so it is left in maintenance mode in
+	// the destination cluster if this fails
+	nextStep(s, "exiting maintenance mode")
+	return c.exitMaintenanceMode(ctx, host, options, s)
+}
 
-	return hosts[0], nil
+func (c *Client) exitMaintenanceMode(ctx context.Context, host *object.HostSystem, options CheckOutOptions, s progress.Sinker) error {
+	return c.runTask(ctx, Action{Step: "exiting maintenance mode", Method: "ExitMaintenanceMode_Task", Object: host.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := host.ExitMaintenanceMode(ctx, 0)
+		if err != nil {
+			return errors.Wrap(err, "creating the exit maintenance mode task failed")
+		}
+
+		_, err = waitForStep(ctx, task, "exiting maintenance mode", options.MaintenanceTimeout, s)
+		return errors.Wrap(err, "bringing the host out of maintenance mode failed")
+	})
 }
 
 func hasCheckedOutHost(ctx context.Context, clusterPath string, finder *find.Finder) (bool, error) {
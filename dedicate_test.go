@@ -58,7 +58,7 @@ func TestIsHostCheckedOutEmptyCluster(t *testing.T) {
 // 	}
 //
 // 	logger := newProgressLogger()
-// 	_, err = CheckOutHost(ctx, service.URL(), false, "/DC0/host/DC0_C0", "/DC0/host/dedicated", logger)
+// 	_, err = CheckOutHost(ctx, service.URL(), false, "/DC0/host/DC0_C0", "/DC0/host/dedicated", CheckOutOptions{}, logger)
 // 	if err != nil {
 // 		t.Fatal(err)
 // 	}
@@ -81,3 +81,46 @@ func createCluster(ctx context.Context, service *SimulatedService, location stri
 
 	return nil
 }
+
+func TestCheckOutSelectedHostRollsBackMaintenanceMode(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createCluster(ctx, service, "/DC0/host", "dedicated"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	host, err := client.finder.HostSystem(ctx, "/DC0/host/DC0_C0/DC0_C0_H0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the simulator can't move hosts into clusters, so the check-out fails
+	// after the host has entered maintenance mode
+	err = client.CheckOutSelectedHost(ctx, host, "/DC0/host/dedicated", CheckOutOptions{}, nil)
+	rollbackErr, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("expected a *RollbackError, got %v", err)
+	}
+	if len(rollbackErr.NotRolledBack) > 0 {
+		t.Fatalf("expected everything to be rolled back, got %v", rollbackErr)
+	}
+
+	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inMaintenanceMode {
+		t.Fatal("expected the host to be out of maintenance mode again")
+	}
+}
@@ -0,0 +1,226 @@
+package vsphereimages
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// The errors below are returned, wrapped with errors.Wrap, when an operation
+// fails for a reason a caller may want to handle differently from other
+// failures. Use errors.Cause to get at them, or IsNotFound, IsAlreadyExists
+// and IsInsufficientSpace, which also recognise the equivalent vSphere
+// faults.
+
+// NotFoundError is returned when an object that an operation needs doesn't
+// exist.
+type NotFoundError struct {
+	// Kind says what was looked for, e.g. "folder".
+	Kind string
+
+	// Path is the inventory path that was looked up.
+	Path string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.Path)
+}
+
+// AlreadyExistsError is returned when a VM is in the way of the one an
+// operation would create.
+type AlreadyExistsError struct {
+	// Path is the inventory path of the VM that is in the way.
+	Path string
+
+	// Hint says how to get it out of the way, if anything other than
+	// removing it is needed.
+	Hint string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	if e.Hint == "" {
+		return e.Path + " already exists"
+	}
+	return e.Path + " already exists, " + e.Hint
+}
+
+// AlreadyCheckedOutError is returned when checking out a host to a cluster
+// that already has one checked out.
+type AlreadyCheckedOutError struct {
+	ClusterPath string
+}
+
+func (e *AlreadyCheckedOutError) Error() string {
+	return "a host is already checked out to the cluster at " + e.ClusterPath
+}
+
+// NoAvailableHostError is returned when a cluster has hosts, but none of them
+// can be used.
+type NoAvailableHostError struct {
+	ClusterPath string
+
+	// Reason says what the hosts would need to be to be used, e.g. "with
+	// only build VMs running".
+	Reason string
+}
+
+func (e *NoAvailableHostError) Error() string {
+	return fmt.Sprintf("no hosts available in %s %s", e.ClusterPath, e.Reason)
+}
+
+// InsufficientSpaceError is returned when the destination datastore of a copy
+// doesn't have room for the source VM.
+type InsufficientSpaceError struct {
+	DatastorePath string
+
+	// FreeSpace is the free space on the datastore, and Needed the storage
+	// committed by the source VM, in bytes.
+	FreeSpace int64
+	Needed    int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("the destination datastore has %d bytes free, but the source VM uses %d bytes", e.FreeSpace, e.Needed)
+}
+
+// FaultError is returned when vSphere fails a task or a request with a fault.
+type FaultError struct {
+	// Fault is the vSphere fault, e.g. *types.InvalidPowerState.
+	Fault types.BaseMethodFault
+
+	// Err is the error the fault was returned as by govmomi.
+	Err error
+}
+
+func (e *FaultError) Error() string {
+	return e.Err.Error()
+}
+
+// StatusError is returned when vCenter answers a request with 503 Service
+// Unavailable, e.g. while vpxd restarts, instead of a fault.
+type StatusError struct {
+	StatusCode int
+
+	// Status is the status line, e.g. "503 Service Unavailable".
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// AsFault returns the *FaultError that err was caused by, if it was caused by
+// a vSphere fault. Faults that a request was answered with, rather than ones
+// that a task failed with, are returned in a new *FaultError.
+func AsFault(err error) (*FaultError, bool) {
+	err = errors.Cause(err)
+	if faultErr, ok := err.(*FaultError); ok {
+		return faultErr, true
+	}
+
+	var fault interface{}
+	switch {
+	case err == nil:
+		return nil, false
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	default:
+		if taskErr, ok := err.(task.Error); ok {
+			fault = taskErr.Fault()
+		}
+	}
+
+	methodFault := toMethodFault(fault)
+	if methodFault == nil {
+		return nil, false
+	}
+
+	return &FaultError{Fault: methodFault, Err: err}, true
+}
+
+// wrapFault returns err as a *FaultError if it is caused by a vSphere fault,
+// and err itself otherwise.
+func wrapFault(err error) error {
+	if faultErr, ok := AsFault(err); ok {
+		return faultErr
+	}
+	return err
+}
+
+// toMethodFault returns fault as a types.BaseMethodFault. Faults are decoded
+// from SOAP responses as values, which only implement it as pointers.
+func toMethodFault(fault interface{}) types.BaseMethodFault {
+	if methodFault, ok := fault.(types.BaseMethodFault); ok {
+		return methodFault
+	}
+	if fault == nil {
+		return nil
+	}
+
+	ptr := reflect.New(reflect.TypeOf(fault))
+	ptr.Elem().Set(reflect.ValueOf(fault))
+	methodFault, _ := ptr.Interface().(types.BaseMethodFault)
+	return methodFault
+}
+
+// IsNotFound returns whether err is caused by a *NotFoundError, an inventory
+// path that govmomi's finder didn't find, or a vSphere NotFound,
+// ManagedObjectNotFound or FileNotFound fault.
+func IsNotFound(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *NotFoundError, *find.NotFoundError:
+		return true
+	}
+
+	if faultErr, ok := AsFault(err); ok {
+		switch faultErr.Fault.(type) {
+		case *types.NotFound, *types.ManagedObjectNotFound, *types.FileNotFound:
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAlreadyExists returns whether err is caused by an *AlreadyExistsError or
+// a vSphere DuplicateName, AlreadyExists or FileAlreadyExists fault.
+func IsAlreadyExists(err error) bool {
+	if _, ok := errors.Cause(err).(*AlreadyExistsError); ok {
+		return true
+	}
+
+	if faultErr, ok := AsFault(err); ok {
+		switch faultErr.Fault.(type) {
+		case *types.DuplicateName, *types.AlreadyExists, *types.FileAlreadyExists:
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsInsufficientSpace returns whether err is caused by an
+// *InsufficientSpaceError or a vSphere NoDiskSpace, InsufficientStorageSpace or
+// FileTooLarge fault, such as a clone task fails with when the destination
+// datastore runs out of room.
+func IsInsufficientSpace(err error) bool {
+	if _, ok := errors.Cause(err).(*InsufficientSpaceError); ok {
+		return true
+	}
+
+	if faultErr, ok := AsFault(err); ok {
+		switch faultErr.Fault.(type) {
+		case *types.NoDiskSpace, *types.InsufficientStorageSpace, *types.FileTooLarge:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package vsphereimages
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestAsFault(t *testing.T) {
+	faultErr := &FaultError{Fault: &types.InvalidPowerState{}, Err: errors.New("the VM is off")}
+
+	tests := []struct {
+		err   error
+		fault types.BaseMethodFault
+	}{
+		{err: nil},
+		{err: errors.New("something broke")},
+		{err: errors.Wrap(faultErr, "powering off failed"), fault: &types.InvalidPowerState{}},
+		{err: taskError(&types.DuplicateName{}), fault: &types.DuplicateName{}},
+		{err: soap.WrapVimFault(&types.HostCommunication{}), fault: &types.HostCommunication{}},
+		{err: soap.WrapSoapFault(&soap.Fault{Detail: struct {
+			Fault types.AnyType `xml:",any,typeattr"`
+		}{Fault: types.NotAuthenticated{}}}), fault: &types.NotAuthenticated{}},
+	}
+
+	for _, test := range tests {
+		got, ok := AsFault(test.err)
+		if ok != (test.fault != nil) {
+			t.Errorf("expected AsFault(%#v) to return %v, got %v", test.err, test.fault != nil, ok)
+			continue
+		}
+		if ok && reflect.TypeOf(got.Fault) != reflect.TypeOf(test.fault) {
+			t.Errorf("expected AsFault(%#v) to return a %T, got a %T", test.err, test.fault, got.Fault)
+		}
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	tests := []struct {
+		err                                        error
+		notFound, alreadyExists, insufficientSpace bool
+	}{
+		{err: errors.New("something broke")},
+		{err: errors.Wrap(&NotFoundError{Kind: "folder", Path: "/DC0/vm/x"}, "finding the folder failed"), notFound: true},
+		{err: taskError(&types.ManagedObjectNotFound{}), notFound: true},
+		{err: &AlreadyExistsError{Path: "/DC0/vm/x"}, alreadyExists: true},
+		{err: taskError(&types.DuplicateName{}), alreadyExists: true},
+		{err: &InsufficientSpaceError{FreeSpace: 1, Needed: 2}, insufficientSpace: true},
+		{err: soap.WrapVimFault(&types.NoDiskSpace{}), insufficientSpace: true},
+		{err: taskError(&types.NoDiskSpace{}), insufficientSpace: true},
+		{err: taskError(&types.FileTooLarge{}), insufficientSpace: true},
+		{err: taskError(&types.InvalidPowerState{})},
+	}
+
+	for _, test := range tests {
+		if IsNotFound(test.err) != test.notFound {
+			t.Errorf("expected IsNotFound(%v) to be %v", test.err, test.notFound)
+		}
+		if IsAlreadyExists(test.err) != test.alreadyExists {
+			t.Errorf("expected IsAlreadyExists(%v) to be %v", test.err, test.alreadyExists)
+		}
+		if IsInsufficientSpace(test.err) != test.insufficientSpace {
+			t.Errorf("expected IsInsufficientSpace(%v) to be %v", test.err, test.insufficientSpace)
+		}
+	}
+}
+
+func TestWaitForTaskFault(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	if _, err = client.finder.VirtualMachine(ctx, "/DC0/vm/missing"); !IsNotFound(err) {
+		t.Fatalf("expected a missing VM not to be found, got %v", err)
+	}
+
+	vm, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = waitForTask(ctx, task, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// powering off a VM that is already off fails
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = waitForTask(ctx, task, nil)
+	faultErr, ok := errors.Cause(err).(*FaultError)
+	if !ok {
+		t.Fatalf("expected a *FaultError, got %#v", err)
+	}
+	if _, ok = faultErr.Fault.(*types.InvalidPowerState); !ok {
+		t.Fatalf("expected an InvalidPowerState fault, got %T", faultErr.Fault)
+	}
+}
@@ -2,15 +2,15 @@ package vsphereimages
 
 import (
 	"context"
-	"crypto/sha1"
-	"crypto/tls"
 	"fmt"
 	"net/url"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/progress"
 	"github.com/vmware/govmomi/vim25/types"
 )
@@ -28,6 +28,15 @@ type ImageSource struct {
 	// crypto/tls.Config.InsecureSkipVerify.
 	VSphereInsecureSkipVerify bool
 
+	// VSphereCAFile is the path to a PEM file with the CA certificates to
+	// trust for the vSphere API, instead of the system's.
+	VSphereCAFile string
+
+	// VSphereSHA256Fingerprint pins the certificate of the vSphere API. If it
+	// is set, only a certificate with this SHA-256 fingerprint is accepted.
+	// It should be formatted as a series of :-separated hexadecimal numbers.
+	VSphereSHA256Fingerprint string
+
 	// VMPath is the inventory path to the source VM. This is usually something
 	// like `/your-datacenter/vm/folder-name/vm-name`.
 	VMPath string
@@ -46,10 +55,21 @@ type ImageDestination struct {
 	// crypto/tls.Config.InsecureSkipVerify.
 	VSphereInsecureSkipVerify bool
 
+	// VSphereCAFile is the path to a PEM file with the CA certificates to
+	// trust for the vSphere API, instead of the system's.
+	VSphereCAFile string
+
+	// VSphereSHA256Fingerprint pins the certificate of the vSphere API. If it
+	// is set, only a certificate with this SHA-256 fingerprint is accepted.
+	// It should be formatted as a series of :-separated hexadecimal numbers.
+	VSphereSHA256Fingerprint string
+
 	// VSphereSHA1Fingerprint is the SHA-1 fingerprint of the vSphere API
-	// endpoint. It should be formatted as a series of :-separated uppercase
-	// hexadecimal numbers. If the string is empty, the ImageCopier will
-	// attempt to connect to the endpoint and use that fingerprint.
+	// endpoint, which the source vCenter uses to verify the destination. It
+	// should be formatted as a series of :-separated uppercase hexadecimal
+	// numbers. If the string is empty, the fingerprint of the certificate
+	// presented by the endpoint is used. If it is set, it must match that
+	// certificate, or a *FingerprintMismatchError is returned.
 	VSphereSHA1Fingerprint string
 
 	// FolderPath is the inventory path to the folder in the destination
@@ -76,38 +96,207 @@ type ImageDestination struct {
 
 	// NetworkPath is the inventory path to the network (dvSwitch, dvPortGroup,
 	// etc.) to connect the copied VM to. Network inventory paths usually look
-	// something like `/your-datacenter/network/name-of-portgroup`.
+	// something like `/your-datacenter/network/name-of-portgroup`. Only the
+	// ethernet-0 NIC is connected to it, and it is ignored if Networks is set.
 	NetworkPath string
 
+	// Networks says which network to connect each of the copied VM's NICs to.
+	// Every NIC must be mapped to a network.
+	Networks NetworkMapping
+
+	// NICPolicy says what to do with the copied VM's NICs if neither
+	// NetworkPath nor Networks is set. Without a policy, the copy fails.
+	NICPolicy NICPolicy
+
+	// ClusterPath is the inventory path to a cluster in the destination
+	// vCenter. If it is set, any of DatastorePath, ResourcePoolPath and
+	// HostPath that are empty are chosen automatically using PlaceImage.
+	ClusterPath string
+
+	// DatastorePattern limits the datastores that are chosen from when
+	// ClusterPath is set to the ones with names matching the pattern. See
+	// path.Match for the pattern syntax.
+	DatastorePattern string
+
 	// VMName is the name to give to the destination VM.
 	VMName string
+
+	// OnConflict controls what happens if a VM named VMName already exists
+	// in the destination folder. The default is ConflictFail.
+	OnConflict ConflictPolicy
+
+	// CloneTimeout limits how long the clone may take. If it takes longer,
+	// the clone is cancelled, the copy is rolled back and a *TimeoutError is
+	// returned. A timeout of 0 means no limit.
+	CloneTimeout time.Duration
 }
 
+// TLSOptions returns the options for verifying the source vSphere API's
+// certificate.
+func (s ImageSource) TLSOptions() TLSOptions {
+	return TLSOptions{
+		InsecureSkipVerify: s.VSphereInsecureSkipVerify,
+		CAFile:             s.VSphereCAFile,
+		SHA256Fingerprint:  s.VSphereSHA256Fingerprint,
+	}
+}
+
+// TLSOptions returns the options for verifying the destination vSphere API's
+// certificate.
+func (d ImageDestination) TLSOptions() TLSOptions {
+	return TLSOptions{
+		InsecureSkipVerify: d.VSphereInsecureSkipVerify,
+		CAFile:             d.VSphereCAFile,
+		SHA256Fingerprint:  d.VSphereSHA256Fingerprint,
+	}
+}
+
+// CopyImage copies a VM from one vCenter to another, using a new session on
+// each of them.
 func CopyImage(ctx context.Context, source ImageSource, destination ImageDestination, s progress.Sinker) error {
-	srcClient, err := govmomi.NewClient(ctx, source.VSphereEndpoint, source.VSphereInsecureSkipVerify)
+	srcClient, err := NewClientWithTLS(ctx, source.VSphereEndpoint, source.TLSOptions())
 	if err != nil {
 		return errors.Wrap(err, "creating source vSphere client failed")
 	}
+	defer srcClient.Logout(ctx)
 
-	destClient, err := govmomi.NewClient(ctx, destination.VSphereEndpoint, destination.VSphereInsecureSkipVerify)
+	destClient, err := NewClientWithTLS(ctx, destination.VSphereEndpoint, destination.TLSOptions())
 	if err != nil {
 		return errors.Wrap(err, "creating destination vSphere client failed")
 	}
+	defer destClient.Logout(ctx)
 
-	srcFinder := find.NewFinder(srcClient.Client, false)
-	destFinder := find.NewFinder(destClient.Client, false)
+	return srcClient.CopyImage(ctx, source.VMPath, destClient, destination, s)
+}
 
-	srcVM, err := srcFinder.VirtualMachine(ctx, source.VMPath)
+// CopyImage copies the VM at vmPath to the vCenter that destClient is
+// connected to. The endpoint and credentials of destClient are used for the
+// copy, so the VSphereEndpoint and VSphereInsecureSkipVerify fields of
+// destination are ignored.
+func (c *Client) CopyImage(ctx context.Context, vmPath string, destClient *Client, destination ImageDestination, s progress.Sinker) error {
+	srcVM, err := c.finder.VirtualMachine(ctx, vmPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the source VM failed")
 	}
 
+	return c.copyVM(ctx, srcVM, destClient, destination, s)
+}
+
+// CopyImageToDestinations copies a VM from one vCenter to several others at
+// the same time. The source vCenter is only logged in to once, and so is each
+// distinct destination vCenter.
+//
+// sinker is called once for each destination to get the progress sinker for
+// the copy to it, and may be nil. The returned slice has an error for each
+// destination, which is nil if the copy to that destination succeeded.
+func CopyImageToDestinations(ctx context.Context, source ImageSource, destinations []ImageDestination, sinker func(ImageDestination) progress.Sinker) []error {
+	errs := make([]error, len(destinations))
+
+	srcClient, err := NewClientWithTLS(ctx, source.VSphereEndpoint, source.TLSOptions())
+	if err != nil {
+		for i := range errs {
+			errs[i] = errors.Wrap(err, "creating source vSphere client failed")
+		}
+		return errs
+	}
+	defer srcClient.Logout(ctx)
+
+	destClients := make([]*Client, len(destinations))
+	clientsByEndpoint := make(map[string]*Client)
+	clientErrs := make(map[string]error)
+	for i, destination := range destinations {
+		key := fmt.Sprintf("%s %+v", destination.VSphereEndpoint, destination.TLSOptions())
+		if err, ok := clientErrs[key]; ok {
+			errs[i] = err
+			continue
+		}
+
+		destClient, ok := clientsByEndpoint[key]
+		if !ok {
+			destClient, err = NewClientWithTLS(ctx, destination.VSphereEndpoint, destination.TLSOptions())
+			if err != nil {
+				clientErrs[key] = errors.Wrap(err, "creating destination vSphere client failed")
+				errs[i] = clientErrs[key]
+				continue
+			}
+			defer destClient.Logout(ctx)
+			clientsByEndpoint[key] = destClient
+		}
+		destClients[i] = destClient
+	}
+
+	copyErrs := srcClient.CopyImageToDestinations(ctx, source.VMPath, destClients, destinations, sinker)
+	for i, err := range copyErrs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+
+	return errs
+}
+
+// CopyImageToDestinations copies the VM at vmPath to several destinations at
+// the same time. The source VM is only looked up once. destClients has the
+// client to use for each destination; destinations with a nil client are
+// skipped. See the CopyImageToDestinations function for details.
+func (c *Client) CopyImageToDestinations(ctx context.Context, vmPath string, destClients []*Client, destinations []ImageDestination, sinker func(ImageDestination) progress.Sinker) []error {
+	errs := make([]error, len(destinations))
+
+	srcVM, err := c.finder.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		for i := range errs {
+			errs[i] = errors.Wrap(err, "finding the source VM failed")
+		}
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	for i, destination := range destinations {
+		if destClients[i] == nil {
+			continue
+		}
+
+		var s progress.Sinker
+		if sinker != nil {
+			s = sinker(destination)
+		}
+
+		wg.Add(1)
+		go func(i int, destination ImageDestination, s progress.Sinker) {
+			defer wg.Done()
+			errs[i] = c.copyVM(ctx, srcVM, destClients[i], destination, s)
+		}(i, destination, s)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (c *Client) copyVM(ctx context.Context, srcVM *object.VirtualMachine, destClient *Client, destination ImageDestination, s progress.Sinker) error {
+	destFinder := destClient.finder
+
+	if destination.NeedsPlacement() {
+		placement, err := destClient.PlaceImage(ctx, destination.ClusterPath, destination.DatastorePattern)
+		if err != nil {
+			return errors.Wrap(err, "choosing where to put the destination VM failed")
+		}
+		destination.FillPlacement(placement)
+	}
+
 	destFolder, err := destFinder.Folder(ctx, destination.FolderPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the destination folder failed")
 	}
 	destFolderRef := destFolder.Reference()
 
+	conflict, err := destClient.checkConflict(ctx, destination.FolderPath, destination.VMName, destination.OnConflict)
+	if err != nil {
+		return err
+	}
+	if conflict.skip {
+		return nil
+	}
+
 	destDatastore, err := destFinder.Datastore(ctx, destination.DatastorePath)
 	if err != nil {
 		return errors.Wrap(err, "finding the destination datastore failed")
@@ -126,48 +315,34 @@ func CopyImage(ctx context.Context, source ImageSource, destination ImageDestina
 	}
 	destHostRef := destHost.Reference()
 
-	destNetwork, err := destFinder.Network(ctx, destination.NetworkPath)
-	if err != nil {
-		return errors.Wrap(err, "finding the destination network failed")
-	}
-
-	backing, err := destNetwork.EthernetCardBackingInfo(ctx)
+	deviceChanges, deviceRemovals, err := nicDeviceChanges(ctx, srcVM, destination.Networks, destination.NetworkPath, destination.NICPolicy, destFinder)
 	if err != nil {
-		return errors.Wrap(err, "getting backing info for destination network failed")
+		return errors.Wrap(err, "connecting the source VM's NICs to destination networks failed")
 	}
 
-	devices, err := srcVM.Device(ctx)
-	if err != nil {
-		return errors.Wrap(err, "getting a list of devices on the source VM failed")
-	}
-
-	netDev := devices.Find("ethernet-0")
-	if netDev == nil {
-		return errors.New("no device with the name 'ethernet-0' was found on the source VM")
-	}
-
-	virtualEthernetCard := netDev.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
-	virtualEthernetCard.Backing = backing
-
-	if destination.VSphereSHA1Fingerprint == "" {
-		hostPort := destination.VSphereEndpoint.Host
+	if destClient.endpoint.Scheme == "https" {
+		hostPort := destClient.endpoint.Host
 		if !hasPort(hostPort) {
-			hostPort = hostPort + ":" + portMap[destination.VSphereEndpoint.Scheme]
+			hostPort = hostPort + ":443"
 		}
 
-		destination.VSphereSHA1Fingerprint, err = findSHA1Fingerprint(hostPort)
+		// the fingerprint is only trusted if the certificate would be trusted
+		// by destClient too
+		fingerprint, err := certificateSHA1Fingerprint(hostPort, destClient.tlsConfig)
 		if err != nil {
 			return errors.Wrap(err, "finding the SHA-1 fingerprint of the destination vCenter failed")
 		}
-	}
 
-	if destination.VSphereEndpoint.User == nil {
-		return errors.New("destination vSphere endpoint doesn't have username and password set")
+		if destination.VSphereSHA1Fingerprint == "" {
+			destination.VSphereSHA1Fingerprint = fingerprint
+		} else if err = checkSHA1Fingerprint(destination.VSphereSHA1Fingerprint, fingerprint); err != nil {
+			return errors.Wrap(err, "verifying the SHA-1 fingerprint of the destination vCenter failed")
+		}
 	}
-	username := destination.VSphereEndpoint.User.Username()
-	password, passwordSet := destination.VSphereEndpoint.User.Password()
-	if !passwordSet {
-		return errors.New("destination vSphere endpoint doesn't have password set")
+
+	username, password, err := destClient.credentials()
+	if err != nil {
+		return errors.Wrap(err, "getting the destination credentials failed")
 	}
 
 	cloneSpec := types.VirtualMachineCloneSpec{
@@ -177,57 +352,57 @@ func CopyImage(ctx context.Context, source ImageSource, destination ImageDestina
 					Username: username,
 					Password: password,
 				},
-				InstanceUuid:  destClient.Client.ServiceContent.About.InstanceUuid,
+				InstanceUuid:  destClient.client.ServiceContent.About.InstanceUuid,
 				SslThumbprint: destination.VSphereSHA1Fingerprint,
-				Url:           fmt.Sprintf("%s://%s", destination.VSphereEndpoint.Scheme, destination.VSphereEndpoint.Host),
-			},
-			Folder:    &destFolderRef,
-			Datastore: &destDatastoreRef,
-			Pool:      &destPoolRef,
-			Host:      &destHostRef,
-			DeviceChange: []types.BaseVirtualDeviceConfigSpec{
-				&types.VirtualDeviceConfigSpec{
-					Operation: types.VirtualDeviceConfigSpecOperationEdit,
-					Device:    virtualEthernetCard,
-				},
+				Url:           fmt.Sprintf("%s://%s", destClient.endpoint.Scheme, destClient.endpoint.Host),
 			},
+			Folder:       &destFolderRef,
+			Datastore:    &destDatastoreRef,
+			Pool:         &destPoolRef,
+			Host:         &destHostRef,
+			DeviceChange: deviceChanges,
 		},
 	}
+	if len(deviceRemovals) > 0 {
+		cloneSpec.Config = &types.VirtualMachineConfigSpec{
+			DeviceChange: deviceRemovals,
+		}
+	}
 
-	cloneTask, err := srcVM.Clone(ctx, destFolder, destination.VMName, cloneSpec)
-	if err != nil {
-		return errors.Wrap(err, "creating VM clone task failed")
+	var t transaction
+	if err = destClient.beforeClone(ctx, &t, conflict, destination.VMName, destination.OnConflict, s); err != nil {
+		return err
 	}
 
-	_, err = cloneTask.WaitForResult(ctx, s)
-	return errors.Wrap(err, "cloning VM failed")
-}
+	// a failed clone may still leave a half-made VM behind, so this is
+	// recorded once the clone has started
+	clonePath := path.Join(destination.FolderPath, conflict.cloneName)
+	recorded := false
+	err = c.runTask(ctx, Action{Step: "cloning " + conflict.cloneName, Method: "CloneVM_Task", Object: srcVM.InventoryPath, Target: clonePath}, s, func(s progress.Sinker) error {
+		cloneTask, err := srcVM.Clone(ctx, destFolder, conflict.cloneName, cloneSpec)
+		if err != nil {
+			return errors.Wrap(err, "creating VM clone task failed")
+		}
 
-func findSHA1Fingerprint(hostport string) (string, error) {
-	conn, err := tls.Dial("tcp", hostport, &tls.Config{
-		InsecureSkipVerify: true,
-	})
-	if err != nil {
-		return "", errors.Wrap(err, "dial failed")
-	}
+		if !recorded {
+			t.done("copying "+conflict.cloneName, func(ctx context.Context) error {
+				return destClient.destroyImage(ctx, clonePath)
+			})
+			recorded = true
+		}
 
-	err = conn.Handshake()
+		_, err = waitForStep(ctx, cloneTask, "cloning "+conflict.cloneName, destination.CloneTimeout, s)
+		return errors.Wrap(err, "cloning VM failed")
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "handshake failed")
+		return t.rollback(ctx, err)
 	}
 
-	certificate := conn.ConnectionState().PeerCertificates[0]
-	sha1Fingerprint := sha1.Sum(certificate.Raw)
-	formattedFingerprint := make([]string, 0, len(sha1Fingerprint))
-	for _, b := range sha1Fingerprint {
-		formattedFingerprint = append(formattedFingerprint, fmt.Sprintf("%02X", b))
+	if err = destClient.afterClone(ctx, &t, conflict, destination.FolderPath, destination.VMName, s); err != nil {
+		return t.rollback(ctx, err)
 	}
-	return strings.Join(formattedFingerprint, ":"), nil
-}
 
-var portMap = map[string]string{
-	"http":  "80",
-	"https": "443",
+	return nil
 }
 
 // Given a string of the form "host", "host:port", or "[ipv6::address]:port",
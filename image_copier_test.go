@@ -2,6 +2,7 @@ package vsphereimages_test
 
 import (
 	"context"
+	"fmt"
 	"net/url"
 
 	vsphereimages "github.com/travis-ci/vsphere-images"
@@ -26,3 +27,38 @@ func ExampleCopyImage() {
 
 	vsphereimages.CopyImage(context.TODO(), source, destination, nil)
 }
+
+func ExampleCopyImageToDestinations() {
+	vSphereSourceURL, _ := url.Parse("https://admin@password:vsphere1.example.com/sdk")
+	vSphereDestinationURL1, _ := url.Parse("https://admin@password:vsphere2.example.com/sdk")
+	vSphereDestinationURL2, _ := url.Parse("https://admin@password:vsphere3.example.com/sdk")
+
+	source := vsphereimages.ImageSource{
+		VSphereEndpoint: vSphereSourceURL,
+		VMPath:          "/dc01/vm/base vms/foo",
+	}
+	destinations := []vsphereimages.ImageDestination{
+		{
+			VSphereEndpoint:  vSphereDestinationURL1,
+			FolderPath:       "/dc02/vm/base vms/",
+			DatastorePath:    "/dc02/datastore/main-datastore",
+			ResourcePoolPath: "/dc02/host/main-pool",
+			HostPath:         "/dc02/host/main-pool/host01",
+			VMName:           "foo",
+		},
+		{
+			VSphereEndpoint:  vSphereDestinationURL2,
+			FolderPath:       "/dc03/vm/base vms/",
+			DatastorePath:    "/dc03/datastore/main-datastore",
+			ResourcePoolPath: "/dc03/host/main-pool",
+			HostPath:         "/dc03/host/main-pool/host01",
+			VMName:           "foo",
+		},
+	}
+
+	for i, err := range vsphereimages.CopyImageToDestinations(context.TODO(), source, destinations, nil) {
+		if err != nil {
+			fmt.Printf("copying to %s failed: %v\n", destinations[i].VSphereEndpoint.Host, err)
+		}
+	}
+}
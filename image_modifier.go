@@ -3,28 +3,26 @@ package vsphereimages
 import (
 	"context"
 	"net/url"
+	"path"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/vim25/progress"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
 func MoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath string, newFolderPath string, newName string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
-
-	finder := find.NewFinder(client.Client, false)
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.MoveImage(ctx, imageInventoryPath, newFolderPath, newName, s)
+	})
+}
 
-	folder, err := finder.Folder(ctx, newFolderPath)
+func (c *Client) MoveImage(ctx context.Context, imageInventoryPath string, newFolderPath string, newName string, s progress.Sinker) error {
+	folder, err := c.finder.Folder(ctx, newFolderPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the destination folder failed")
 	}
 
-	vm, err := finder.VirtualMachine(ctx, imageInventoryPath)
+	vm, err := c.finder.VirtualMachine(ctx, imageInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the VM failed")
 	}
@@ -33,102 +31,105 @@ func MoveImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSki
 		Name: newName,
 	}
 
-	task, err := vm.Reconfigure(ctx, configSpec)
-	if err != nil {
-		return errors.Wrap(err, "creating the VM rename task failed")
-	}
+	err = c.runTask(ctx, Action{Step: "renaming the VM", Method: "Reconfigure_Task", Object: vm.InventoryPath, Target: path.Join(path.Dir(vm.InventoryPath), newName)}, s, func(s progress.Sinker) error {
+		task, err := vm.Reconfigure(ctx, configSpec)
+		if err != nil {
+			return errors.Wrap(err, "creating the VM rename task failed")
+		}
 
-	_, err = task.WaitForResult(ctx, s)
-	if err != nil {
+		_, err = waitForTask(ctx, task, s)
 		return errors.Wrap(err, "renaming the VM failed")
-	}
-
-	task, err = folder.MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+	})
 	if err != nil {
-		return errors.Wrap(err, "creating the VM move task failed")
+		return err
 	}
 
-	_, err = task.WaitForResult(ctx, s)
-	return errors.Wrap(err, "moving the VM failed")
+	return c.runTask(ctx, Action{Step: "moving the VM", Method: "MoveIntoFolder_Task", Object: path.Join(path.Dir(vm.InventoryPath), newName), Target: folder.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := folder.MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+		if err != nil {
+			return errors.Wrap(err, "creating the VM move task failed")
+		}
+
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "moving the VM failed")
+	})
 }
 
 func ConfigureImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath string, config types.VirtualMachineConfigSpec, networkName string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.ConfigureImage(ctx, imageInventoryPath, config, networkName, s)
+	})
+}
 
-	finder := find.NewFinder(client.Client, false)
+// ConfigureImage reconfigures a VM. If networkName is set, the ethernet-0 NIC
+// is connected to it.
+func (c *Client) ConfigureImage(ctx context.Context, imageInventoryPath string, config types.VirtualMachineConfigSpec, networkName string, s progress.Sinker) error {
+	return c.configureImage(ctx, imageInventoryPath, config, nil, networkName, s)
+}
+
+// ConfigureImageNetworks reconfigures a VM like ConfigureImage, but connects
+// each of its NICs to the network given by networks. If networks is empty,
+// the NICs are left alone, otherwise every NIC must be mapped.
+func ConfigureImageNetworks(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath string, config types.VirtualMachineConfigSpec, networks NetworkMapping, s progress.Sinker) error {
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.ConfigureImageNetworks(ctx, imageInventoryPath, config, networks, s)
+	})
+}
+
+// ConfigureImageNetworks reconfigures a VM. See the ConfigureImageNetworks
+// function for details.
+func (c *Client) ConfigureImageNetworks(ctx context.Context, imageInventoryPath string, config types.VirtualMachineConfigSpec, networks NetworkMapping, s progress.Sinker) error {
+	return c.configureImage(ctx, imageInventoryPath, config, networks, "", s)
+}
 
-	vm, err := finder.VirtualMachine(ctx, imageInventoryPath)
+func (c *Client) configureImage(ctx context.Context, imageInventoryPath string, config types.VirtualMachineConfigSpec, networks NetworkMapping, networkName string, s progress.Sinker) error {
+	vm, err := c.finder.VirtualMachine(ctx, imageInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the VM failed")
 	}
 
-	if networkName != "" {
-		devices, err := vm.Device(ctx)
+	if len(networks) > 0 || networkName != "" {
+		config.DeviceChange, _, err = nicDeviceChanges(ctx, vm, networks, networkName, "", c.finder)
 		if err != nil {
-			return errors.Wrap(err, "loading VM devices failed")
-		}
-
-		net := devices.Find("ethernet-0")
-		if net == nil {
-			return errors.New("could not find 'ethernet-0' device")
-		}
-
-		network, err := finder.Network(ctx, networkName)
-		if err != nil {
-			return errors.Wrap(err, "finding the network failed")
+			return errors.Wrap(err, "connecting the VM's NICs to networks failed")
 		}
+	}
 
-		backing, err := network.EthernetCardBackingInfo(ctx)
+	return c.runTask(ctx, Action{Step: "reconfiguring the VM", Method: "Reconfigure_Task", Object: vm.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := vm.Reconfigure(ctx, config)
 		if err != nil {
-			return errors.Wrap(err, "creating network backing info failed")
+			return errors.Wrap(err, "creating the VM config task failed")
 		}
 
-		card := net.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
-		card.Backing = backing
-
-		config.DeviceChange = []types.BaseVirtualDeviceConfigSpec{
-			&types.VirtualDeviceConfigSpec{
-				Device:    net,
-				Operation: types.VirtualDeviceConfigSpecOperationEdit,
-			},
-		}
-	}
-
-	task, err := vm.Reconfigure(ctx, config)
-	if err != nil {
-		return errors.Wrap(err, "creating the VM config task failed")
-	}
-
-	_, err = task.WaitForResult(ctx, s)
-	return errors.Wrap(err, "reconfiguring the VM failed")
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "reconfiguring the VM failed")
+	})
 }
 
 func MigrateImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath string, poolInventoryPath string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
-
-	finder := find.NewFinder(client.Client, false)
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.MigrateImage(ctx, imageInventoryPath, poolInventoryPath, s)
+	})
+}
 
-	vm, err := finder.VirtualMachine(ctx, imageInventoryPath)
+func (c *Client) MigrateImage(ctx context.Context, imageInventoryPath string, poolInventoryPath string, s progress.Sinker) error {
+	vm, err := c.finder.VirtualMachine(ctx, imageInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the VM failed")
 	}
 
-	pool, err := finder.ResourcePool(ctx, poolInventoryPath)
+	pool, err := c.finder.ResourcePool(ctx, poolInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the resource pool failed")
 	}
 
-	task, err := vm.Migrate(ctx, pool, nil, types.VirtualMachineMovePriorityDefaultPriority, types.VirtualMachinePowerStatePoweredOff)
-	if err != nil {
-		return errors.Wrap(err, "creating the migrate task failed")
-	}
+	return c.runTask(ctx, Action{Step: "migrating the VM", Method: "MigrateVM_Task", Object: vm.InventoryPath, Target: pool.InventoryPath}, s, func(s progress.Sinker) error {
+		task, err := vm.Migrate(ctx, pool, nil, types.VirtualMachineMovePriorityDefaultPriority, types.VirtualMachinePowerStatePoweredOff)
+		if err != nil {
+			return errors.Wrap(err, "creating the migrate task failed")
+		}
 
-	_, err = task.WaitForResult(ctx, s)
-	return errors.Wrap(err, "migrating the VM failed")
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "migrating the VM failed")
+	})
 }
@@ -2,26 +2,336 @@ package vsphereimages
 
 import (
 	"context"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
-	"net/url"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 // ListImages returns a list of all of the virtual machines in a folder.
+//
+// The client used to find the VMs is logged out before ListImages returns, so
+// the returned VMs can't be used to make further API calls. Use
+// Client.ListImages for that.
 func ListImages(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, folderPath string) ([]*object.VirtualMachine, error) {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
+	var vms []*object.VirtualMachine
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		vms, err = c.ListImages(ctx, folderPath)
+		return err
+	})
+	return vms, err
+}
+
+// ListImages returns a list of all of the virtual machines in a folder.
+func (c *Client) ListImages(ctx context.Context, folderPath string) ([]*object.VirtualMachine, error) {
+	vms, err := c.finder.VirtualMachineList(ctx, folderPath+"/*")
 	if err != nil {
-		return nil, errors.Wrap(err, "creating vSphere client failed")
+		return nil, errors.Wrap(err, "finding the VMs failed")
+	}
+
+	return vms, nil
+}
+
+// ImageInfo describes a single image.
+type ImageInfo struct {
+	Name             string            `json:"name" yaml:"name"`
+	InventoryPath    string            `json:"inventory_path" yaml:"inventory_path"`
+	Datastores       []string          `json:"datastores" yaml:"datastores"`
+	GuestID          string            `json:"guest_id" yaml:"guest_id"`
+	GuestFullName    string            `json:"guest_full_name" yaml:"guest_full_name"`
+	NumCPUs          int32             `json:"num_cpus" yaml:"num_cpus"`
+	MemoryMB         int32             `json:"memory_mb" yaml:"memory_mb"`
+	Snapshots        []string          `json:"snapshots" yaml:"snapshots"`
+	PowerState       string            `json:"power_state" yaml:"power_state"`
+	Modified         time.Time         `json:"modified" yaml:"modified"`
+	Annotation       string            `json:"annotation" yaml:"annotation"`
+	CustomAttributes map[string]string `json:"custom_attributes" yaml:"custom_attributes"`
+}
+
+// ImageFilter selects which images FindImages returns. An image has to match
+// every field that is set.
+type ImageFilter struct {
+	// Name is a shell pattern (see path.Match) that the image's name has to
+	// match.
+	Name string
+
+	// NameRegexp is a regular expression that the image's name has to match.
+	NameRegexp *regexp.Regexp
+
+	// Guest is a shell pattern that either the image's guest ID (e.g.
+	// `ubuntu64Guest`) or its full guest OS name has to match.
+	Guest string
+
+	// CustomAttributes maps the names of custom attributes to the values the
+	// image has to have for them.
+	CustomAttributes map[string]string
+
+	// Annotation is a string that the image's annotation has to contain.
+	Annotation string
+}
+
+func (f ImageFilter) matches(info ImageInfo) bool {
+	if f.Name != "" {
+		if ok, _ := path.Match(f.Name, info.Name); !ok {
+			return false
+		}
 	}
 
-	finder := find.NewFinder(client.Client, false)
+	if f.NameRegexp != nil && !f.NameRegexp.MatchString(info.Name) {
+		return false
+	}
+
+	if f.Guest != "" {
+		idOK, _ := path.Match(f.Guest, info.GuestID)
+		nameOK, _ := path.Match(f.Guest, info.GuestFullName)
+		if !idOK && !nameOK {
+			return false
+		}
+	}
 
-	vms, err := finder.VirtualMachineList(ctx, folderPath+"/*")
+	for name, value := range f.CustomAttributes {
+		if actual, ok := info.CustomAttributes[name]; !ok || actual != value {
+			return false
+		}
+	}
+
+	return strings.Contains(info.Annotation, f.Annotation)
+}
+
+// ListImageInfo returns information about all of the virtual machines in a
+// folder.
+func ListImageInfo(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, folderPath string) ([]ImageInfo, error) {
+	var infos []ImageInfo
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		infos, err = c.ListImageInfo(ctx, folderPath)
+		return err
+	})
+	return infos, err
+}
+
+// ListImageInfo returns information about all of the virtual machines in a
+// folder.
+func (c *Client) ListImageInfo(ctx context.Context, folderPath string) ([]ImageInfo, error) {
+	vms, err := c.ListImages(ctx, folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := c.imageInfo(ctx, vms)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting information about the VMs failed")
+	}
+
+	return infos, nil
+}
+
+// FindImages returns information about the virtual machines in a folder that
+// match filter. If recursive is true, virtual machines in sub-folders are
+// included too. The folder path may also be the path of a datacenter, to find
+// images anywhere in that datacenter.
+func FindImages(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, folderPath string, recursive bool, filter ImageFilter) ([]ImageInfo, error) {
+	var infos []ImageInfo
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		infos, err = c.FindImages(ctx, folderPath, recursive, filter)
+		return err
+	})
+	return infos, err
+}
+
+// FindImages returns information about the virtual machines in a folder that
+// match filter. See the FindImages function for details.
+func (c *Client) FindImages(ctx context.Context, folderPath string, recursive bool, filter ImageFilter) ([]ImageInfo, error) {
+	ref, err := object.NewSearchIndex(c.client.Client).FindByInventoryPath(ctx, folderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding the folder failed")
+	}
+	if ref == nil {
+		return nil, errors.Wrap(&NotFoundError{Kind: "folder", Path: folderPath}, "finding the folder failed")
+	}
+
+	pattern := folderPath + "/*"
+	if recursive {
+		pattern = folderPath + "/..."
+	}
+
+	vms, err := c.finder.VirtualMachineList(ctx, pattern)
+	if _, ok := err.(*find.NotFoundError); ok {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "finding the VMs failed")
 	}
 
-	return vms, nil
+	infos, err := c.imageInfo(ctx, vms)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting information about the VMs failed")
+	}
+
+	var matching []ImageInfo
+	for _, info := range infos {
+		if filter.matches(info) {
+			matching = append(matching, info)
+		}
+	}
+
+	return matching, nil
+}
+
+var imageInfoProperties = []string{
+	"name",
+	"config.guestId",
+	"config.guestFullName",
+	"config.annotation",
+	"config.hardware.numCPU",
+	"config.hardware.memoryMB",
+	"config.modified",
+	"datastore",
+	"snapshot",
+	"runtime.powerState",
+	"customValue",
+}
+
+// imageInfo retrieves the properties of the given VMs and returns them in the
+// same order.
+func (c *Client) imageInfo(ctx context.Context, vms []*object.VirtualMachine) ([]ImageInfo, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(vms))
+	for _, vm := range vms {
+		refs = append(refs, vm.Reference())
+	}
+
+	var mvms []mo.VirtualMachine
+	if err := c.client.Retrieve(ctx, refs, imageInfoProperties, &mvms); err != nil {
+		return nil, err
+	}
+
+	datastoreNames, err := c.datastoreNames(ctx, mvms)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldNames, err := c.customFieldNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byRef := make(map[types.ManagedObjectReference]mo.VirtualMachine, len(mvms))
+	for _, mvm := range mvms {
+		byRef[mvm.Self] = mvm
+	}
+
+	infos := make([]ImageInfo, 0, len(vms))
+	for _, vm := range vms {
+		mvm := byRef[vm.Reference()]
+
+		info := ImageInfo{
+			Name:          mvm.Name,
+			InventoryPath: vm.InventoryPath,
+			PowerState:    string(mvm.Runtime.PowerState),
+		}
+
+		if mvm.Config != nil {
+			info.GuestID = mvm.Config.GuestId
+			info.GuestFullName = mvm.Config.GuestFullName
+			info.Annotation = mvm.Config.Annotation
+			info.NumCPUs = mvm.Config.Hardware.NumCPU
+			info.MemoryMB = mvm.Config.Hardware.MemoryMB
+			info.Modified = mvm.Config.Modified
+		}
+
+		for _, ref := range mvm.Datastore {
+			info.Datastores = append(info.Datastores, datastoreNames[ref])
+		}
+
+		if mvm.Snapshot != nil {
+			info.Snapshots = snapshotNames(mvm.Snapshot.RootSnapshotList)
+		}
+
+		for _, value := range mvm.CustomValue {
+			if value, ok := value.(*types.CustomFieldStringValue); ok {
+				if info.CustomAttributes == nil {
+					info.CustomAttributes = make(map[string]string)
+				}
+				info.CustomAttributes[fieldNames[value.Key]] = value.Value
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// datastoreNames returns the names of all datastores used by the given VMs.
+func (c *Client) datastoreNames(ctx context.Context, mvms []mo.VirtualMachine) (map[types.ManagedObjectReference]string, error) {
+	names := make(map[types.ManagedObjectReference]string)
+
+	var refs []types.ManagedObjectReference
+	for _, mvm := range mvms {
+		for _, ref := range mvm.Datastore {
+			if _, ok := names[ref]; !ok {
+				names[ref] = ""
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		return names, nil
+	}
+
+	var mdss []mo.Datastore
+	if err := c.client.Retrieve(ctx, refs, []string{"name"}, &mdss); err != nil {
+		return nil, err
+	}
+
+	for _, mds := range mdss {
+		names[mds.Self] = mds.Name
+	}
+
+	return names, nil
+}
+
+// customFieldNames returns the names of all custom attributes by their key.
+// Only vCenter supports custom attributes, so there are none on ESXi.
+func (c *Client) customFieldNames(ctx context.Context) (map[int32]string, error) {
+	names := make(map[int32]string)
+	if !c.client.IsVC() {
+		return names, nil
+	}
+
+	fields, err := object.NewCustomFieldsManager(c.client.Client).Field(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		names[field.Key] = field.Name
+	}
+
+	return names, nil
+}
+
+// snapshotNames returns the names of all snapshots in a snapshot tree, with
+// parents before their children.
+func snapshotNames(trees []types.VirtualMachineSnapshotTree) []string {
+	var names []string
+	for _, tree := range trees {
+		names = append(names, tree.Name)
+		names = append(names, snapshotNames(tree.ChildSnapshotList)...)
+	}
+	return names
 }
@@ -3,6 +3,9 @@ package vsphereimages
 import (
 	"context"
 	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 func TestListImages(t *testing.T) {
@@ -25,3 +28,131 @@ func TestListImages(t *testing.T) {
 		t.Fatalf("unexpected first VM name, got %s", vms[0].Name())
 	}
 }
+
+func TestListImageInfo(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = SnapshotImage(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM0", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ListImageInfo(ctx, service.URL(), false, "/DC0/vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 8 {
+		t.Fatalf("unexpected number of images, expected 8, got %d", len(infos))
+	}
+
+	info := infos[0]
+	if info.Name != "DC0_H0_VM0" || info.InventoryPath != "/DC0/vm/DC0_H0_VM0" {
+		t.Fatalf("unexpected first image %s at %s", info.Name, info.InventoryPath)
+	}
+	if len(info.Datastores) != 1 || info.Datastores[0] != "LocalDS_0" {
+		t.Fatalf("unexpected datastores %v", info.Datastores)
+	}
+	if len(info.Snapshots) != 1 || info.Snapshots[0] != "base" {
+		t.Fatalf("unexpected snapshots %v", info.Snapshots)
+	}
+	if info.PowerState != "poweredOn" {
+		t.Fatalf("unexpected power state %s", info.PowerState)
+	}
+}
+
+func TestFindImagesRecursive(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "base"); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = MoveImage(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/base", "travis-ci-xenial", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := FindImages(ctx, service.URL(), false, "/DC0", true, ImageFilter{Name: "*xenial*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 {
+		t.Fatalf("unexpected number of images, expected 1, got %d", len(infos))
+	}
+	if infos[0].InventoryPath != "/DC0/vm/base/travis-ci-xenial" {
+		t.Fatalf("unexpected image path %s", infos[0].InventoryPath)
+	}
+
+	infos, err = FindImages(ctx, service.URL(), false, "/DC0/vm", false, ImageFilter{Name: "*xenial*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("expected no images outside of sub-folders, got %d", len(infos))
+	}
+}
+
+func TestFindImagesByAnnotationAndAttribute(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	config := types.VirtualMachineConfigSpec{Annotation: "built by packer for xenial"}
+	if err = client.ConfigureImage(ctx, "/DC0/vm/DC0_H0_VM1", config, "", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := object.NewCustomFieldsManager(client.client.Client)
+	field, err := fields.Add(ctx, "dist", "VirtualMachine", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fields.Set(ctx, vm.Reference(), field.Key, "xenial"); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := client.FindImages(ctx, "/DC0/vm", false, ImageFilter{Annotation: "xenial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "DC0_H0_VM1" {
+		t.Fatalf("unexpected images matching annotation: %v", infos)
+	}
+
+	infos, err = client.FindImages(ctx, "/DC0/vm", false, ImageFilter{CustomAttributes: map[string]string{"dist": "xenial"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "DC0_H0_VM0" {
+		t.Fatalf("unexpected images matching custom attribute: %v", infos)
+	}
+}
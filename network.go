@@ -0,0 +1,209 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// NetworkMapping says which network to connect each NIC of a VM to. The keys
+// are either device names, like "ethernet-0", or the name of the network a
+// NIC is connected to now. The values are inventory paths to networks, which
+// usually look something like `/your-datacenter/network/name-of-portgroup`.
+// Device names take precedence over network names.
+type NetworkMapping map[string]string
+
+// ParseNetworkMapping parses a network mapping written as a comma-separated
+// list of key=network-path pairs, e.g.
+// `ethernet-0=/dc/network/a,ethernet-1=/dc/network/b`.
+func ParseNetworkMapping(s string) (NetworkMapping, error) {
+	mapping := make(NetworkMapping)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid network mapping %q, must be of the form nic-or-network=network-path", pair)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+
+	return mapping, nil
+}
+
+// NICPolicy controls what happens to the NICs of a copied VM when no
+// destination network is given.
+type NICPolicy string
+
+const (
+	// NICPolicyKeep leaves the NICs connected to the same networks as on the
+	// source VM.
+	NICPolicyKeep NICPolicy = "keep"
+
+	// NICPolicyRemove removes all of the NICs.
+	NICPolicyRemove NICPolicy = "remove"
+)
+
+// ParseNICPolicy returns the NICPolicy with the given name. An empty name is
+// no policy, which makes copies without a destination network fail.
+func ParseNICPolicy(name string) (NICPolicy, error) {
+	switch policy := NICPolicy(name); policy {
+	case "", NICPolicyKeep, NICPolicyRemove:
+		return policy, nil
+	}
+
+	return "", errors.Errorf("unknown NIC policy %q, must be keep or remove", name)
+}
+
+// nicDeviceChanges returns the device changes that connect the VM's NICs to
+// networks. If mapping is empty, only ethernet-0 is connected to networkPath,
+// which is how networks were given before NetworkMapping existed.
+//
+// If neither is given, policy decides what happens to the NICs. Removing NICs
+// can't be done by a relocate spec, so removals are returned separately from
+// the changes to the NICs' backings.
+func nicDeviceChanges(ctx context.Context, vm *object.VirtualMachine, mapping NetworkMapping, networkPath string, policy NICPolicy, destFinder *find.Finder) (edits []types.BaseVirtualDeviceConfigSpec, removals []types.BaseVirtualDeviceConfigSpec, err error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting a list of devices on the VM failed")
+	}
+
+	if len(mapping) == 0 && networkPath == "" {
+		switch policy {
+		case NICPolicyKeep:
+			return nil, nil, nil
+		case NICPolicyRemove:
+			removals, err = devices.SelectByType((*types.VirtualEthernetCard)(nil)).ConfigSpec(types.VirtualDeviceConfigSpecOperationRemove)
+			return nil, removals, err
+		default:
+			return nil, nil, errors.New("no destination network was given, and no NIC policy says whether to keep or remove the NICs")
+		}
+	}
+
+	if len(mapping) == 0 {
+		netDev := devices.Find("ethernet-0")
+		if netDev == nil {
+			return nil, nil, errors.New("no device with the name 'ethernet-0' was found on the VM")
+		}
+
+		devices = object.VirtualDeviceList{netDev}
+		mapping = NetworkMapping{"ethernet-0": networkPath}
+	}
+
+	edits, err = networkDeviceChanges(ctx, vm, devices, mapping, destFinder)
+	return edits, nil, err
+}
+
+// networkDeviceChanges returns the device changes that connect every NIC on
+// the VM to the network it is mapped to, looking the networks up with
+// destFinder. If any NICs aren't mapped, an error listing all of them is
+// returned.
+func networkDeviceChanges(ctx context.Context, vm *object.VirtualMachine, devices object.VirtualDeviceList, mapping NetworkMapping, destFinder *find.Finder) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+
+	networkNames, err := nicNetworkNames(ctx, vm, nics)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding the networks the VM's NICs are connected to failed")
+	}
+
+	var unmapped []string
+	var changes []types.BaseVirtualDeviceConfigSpec
+	backings := make(map[string]types.BaseVirtualDeviceBackingInfo)
+	for _, nic := range nics {
+		name := devices.Name(nic)
+
+		networkPath, ok := mapping[name]
+		if !ok {
+			networkPath, ok = mapping[networkNames[name]]
+		}
+		if !ok {
+			unmapped = append(unmapped, fmt.Sprintf("%s (connected to %q)", name, networkNames[name]))
+			continue
+		}
+
+		backing, ok := backings[networkPath]
+		if !ok {
+			network, err := destFinder.Network(ctx, networkPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "finding the network for %s failed", name)
+			}
+
+			backing, err = network.EthernetCardBackingInfo(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting backing info for the network for %s failed", name)
+			}
+			backings[networkPath] = backing
+		}
+
+		card := nic.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+		card.Backing = backing
+
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    nic,
+		})
+	}
+
+	if len(unmapped) > 0 {
+		return nil, errors.Errorf("no network given for %s", strings.Join(unmapped, ", "))
+	}
+
+	return changes, nil
+}
+
+// nicNetworkNames returns the name of the network each of the NICs is
+// connected to, by device name.
+func nicNetworkNames(ctx context.Context, vm *object.VirtualMachine, nics object.VirtualDeviceList) (map[string]string, error) {
+	var mvm mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"network"}, &mvm); err != nil {
+		return nil, err
+	}
+
+	namesByRef := make(map[types.ManagedObjectReference]string)
+	namesByPortgroupKey := make(map[string]string)
+	for _, ref := range mvm.Network {
+		if ref.Type == "DistributedVirtualPortgroup" {
+			var mpg mo.DistributedVirtualPortgroup
+			if err := vm.Properties(ctx, ref, []string{"name", "key"}, &mpg); err != nil {
+				return nil, err
+			}
+			namesByRef[ref] = mpg.Name
+			namesByPortgroupKey[mpg.Key] = mpg.Name
+			continue
+		}
+
+		var mnet mo.Network
+		if err := vm.Properties(ctx, ref, []string{"name"}, &mnet); err != nil {
+			return nil, err
+		}
+		namesByRef[ref] = mnet.Name
+	}
+
+	names := make(map[string]string)
+	for _, nic := range nics {
+		name := nics.Name(nic)
+
+		switch backing := nic.GetVirtualDevice().Backing.(type) {
+		case *types.VirtualEthernetCardNetworkBackingInfo:
+			names[name] = backing.DeviceName
+			if backing.Network != nil && namesByRef[*backing.Network] != "" {
+				names[name] = namesByRef[*backing.Network]
+			}
+		case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+			names[name] = namesByPortgroupKey[backing.Port.PortgroupKey]
+		case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+			names[name] = backing.OpaqueNetworkId
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,190 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestParseNetworkMapping(t *testing.T) {
+	mapping, err := ParseNetworkMapping("ethernet-0=/DC0/network/A, VM Network=/DC0/network/B,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mapping) != 2 || mapping["ethernet-0"] != "/DC0/network/A" || mapping["VM Network"] != "/DC0/network/B" {
+		t.Fatalf("unexpected mapping %v", mapping)
+	}
+
+	if _, err = ParseNetworkMapping("ethernet-0"); err == nil {
+		t.Fatal("expected error parsing mapping without a network, but none occurred")
+	}
+}
+
+// addNIC adds a NIC connected to the network at networkPath to the VM.
+func addNIC(ctx context.Context, service *SimulatedService, vmPath string, networkPath string) error {
+	finder, err := service.NewFinder(ctx)
+	if err != nil {
+		return err
+	}
+
+	vm, err := finder.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		return err
+	}
+
+	network, err := finder.Network(ctx, networkPath)
+	if err != nil {
+		return err
+	}
+
+	backing, err := network.EthernetCardBackingInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return err
+	}
+
+	nic, err := devices.CreateEthernetCard("e1000", backing)
+	if err != nil {
+		return err
+	}
+
+	// the simulator doesn't pick a unit number, which the device name is
+	// based on
+	nic.GetVirtualDevice().UnitNumber = types.NewInt32(int32(7 + len(devices.SelectByType((*types.VirtualEthernetCard)(nil)))))
+
+	return vm.AddDevice(ctx, nic)
+}
+
+func vmNICNetworkNames(ctx context.Context, service *SimulatedService, vmPath string) (map[string]string, error) {
+	finder, err := service.NewFinder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := finder.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return nicNetworkNames(ctx, vm, devices.SelectByType((*types.VirtualEthernetCard)(nil)))
+}
+
+func TestConfigureImageNetworks(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	vmPath := "/DC0/vm/DC0_H0_VM0"
+	if err = addNIC(ctx, service, vmPath, "/DC0/network/VM Network"); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := vmNICNetworkNames(ctx, service, vmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 2 || before["ethernet-0"] != "DC0_DVPG0" || before["ethernet-1"] != "VM Network" {
+		t.Fatalf("unexpected NICs %v", before)
+	}
+
+	err = ConfigureImageNetworks(ctx, service.URL(), false, vmPath, types.VirtualMachineConfigSpec{}, NetworkMapping{
+		"ethernet-0": "/DC0/network/VM Network",
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), `no network given for ethernet-1 (connected to "VM Network")`) {
+		t.Fatalf("expected error about unmapped NIC, got %v", err)
+	}
+
+	err = ConfigureImageNetworks(ctx, service.URL(), false, vmPath, types.VirtualMachineConfigSpec{}, NetworkMapping{
+		"DC0_DVPG0":  "/DC0/network/VM Network",
+		"ethernet-1": "/DC0/network/DC0_DVPG0",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := vmNICNetworkNames(ctx, service, vmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["ethernet-0"] != "VM Network" || after["ethernet-1"] != "DC0_DVPG0" {
+		t.Fatalf("expected the NICs' networks to be swapped, got %v", after)
+	}
+}
+
+func TestCopyImageNICPolicy(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	destination := simulatorCopyDestination(service, "copy")
+	destination.NetworkPath = ""
+
+	err = CopyImage(ctx, source, destination, nil)
+	if err == nil || !strings.Contains(err.Error(), "no NIC policy says whether to keep or remove the NICs") {
+		t.Fatalf("expected error about the NIC policy, got %v", err)
+	}
+
+	destination.NICPolicy = NICPolicyKeep
+	if err = CopyImage(ctx, source, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	networks, err := vmNICNetworkNames(ctx, service, "/DC0/vm/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networks["ethernet-0"] != "DC0_DVPG0" {
+		t.Fatalf("expected ethernet-0 to still be connected to DC0_DVPG0, got %v", networks)
+	}
+}
+
+func TestNICDeviceChangesRemove(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	finder, err := service.NewFinder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the simulator doesn't apply the config spec of a clone, so only the
+	// changes are checked here
+	edits, removals, err := nicDeviceChanges(ctx, vm, nil, "", NICPolicyRemove, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 0 || len(removals) != 1 {
+		t.Fatalf("expected no edits and 1 removal, got %d and %d", len(edits), len(removals))
+	}
+	if op := removals[0].GetVirtualDeviceConfigSpec().Operation; op != types.VirtualDeviceConfigSpecOperationRemove {
+		t.Fatalf("expected a remove operation, got %s", op)
+	}
+}
@@ -0,0 +1,198 @@
+package vsphereimages
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Placement is where in a cluster PlaceImage decided to put a VM.
+type Placement struct {
+	// DatastorePath is the inventory path to the chosen datastore.
+	DatastorePath string
+
+	// DatastoreFreeSpace is the free space on the chosen datastore, in bytes.
+	DatastoreFreeSpace int64
+
+	// ResourcePoolPath is the inventory path to the cluster's root resource
+	// pool.
+	ResourcePoolPath string
+
+	// HostPath is the inventory path to the chosen host.
+	HostPath string
+}
+
+// NeedsPlacement returns whether the destination is a cluster in which
+// PlaceImage has to choose any of the datastore, resource pool and host,
+// because their paths are empty.
+func (d *ImageDestination) NeedsPlacement() bool {
+	return d.ClusterPath != "" && (d.DatastorePath == "" || d.ResourcePoolPath == "" || d.HostPath == "")
+}
+
+// FillPlacement sets the datastore, resource pool and host paths of the
+// destination that are empty to the ones from placement.
+func (d *ImageDestination) FillPlacement(placement Placement) {
+	if d.DatastorePath == "" {
+		d.DatastorePath = placement.DatastorePath
+	}
+	if d.ResourcePoolPath == "" {
+		d.ResourcePoolPath = placement.ResourcePoolPath
+	}
+	if d.HostPath == "" {
+		d.HostPath = placement.HostPath
+	}
+}
+
+// PlaceImage chooses where in a cluster to put a VM. The datastore is the one
+// with the most free space out of the accessible datastores in the cluster
+// with names matching datastorePattern (see path.Match), or all of them if
+// datastorePattern is empty. The host is a connected host in the cluster that
+// isn't in maintenance mode and has the datastore mounted.
+func PlaceImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, clusterPath string, datastorePattern string) (Placement, error) {
+	var placement Placement
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		placement, err = c.PlaceImage(ctx, clusterPath, datastorePattern)
+		return err
+	})
+	return placement, err
+}
+
+// PlaceImage chooses where in a cluster to put a VM. See the PlaceImage
+// function for details.
+func (c *Client) PlaceImage(ctx context.Context, clusterPath string, datastorePattern string) (Placement, error) {
+	var placement Placement
+
+	if datastorePattern != "" {
+		if _, err := path.Match(datastorePattern, ""); err != nil {
+			return placement, errors.Wrap(err, "invalid datastore pattern")
+		}
+	}
+
+	cluster, err := c.finder.ClusterComputeResource(ctx, clusterPath)
+	if err != nil {
+		return placement, errors.Wrap(err, "finding the cluster failed")
+	}
+
+	var mcluster mo.ClusterComputeResource
+	err = cluster.Properties(ctx, cluster.Reference(), []string{"datastore", "host", "resourcePool"}, &mcluster)
+	if err != nil {
+		return placement, errors.Wrap(err, "getting the cluster's datastores and hosts failed")
+	}
+
+	if len(mcluster.Host) == 0 {
+		return placement, errors.New("no hosts found in cluster")
+	}
+
+	var mhosts []mo.HostSystem
+	err = c.client.Retrieve(ctx, mcluster.Host, []string{"name", "runtime"}, &mhosts)
+	if err != nil {
+		return placement, errors.Wrap(err, "getting host information failed")
+	}
+
+	hosts := availablePlacementHosts(mhosts)
+	if len(hosts) == 0 {
+		return placement, &NoAvailableHostError{ClusterPath: clusterPath, Reason: "that are connected and outside maintenance mode"}
+	}
+
+	if len(mcluster.Datastore) == 0 {
+		return placement, errors.New("no datastores found in cluster")
+	}
+
+	var mdatastores []mo.Datastore
+	err = c.client.Retrieve(ctx, mcluster.Datastore, []string{"name", "summary", "host"}, &mdatastores)
+	if err != nil {
+		return placement, errors.Wrap(err, "getting datastore information failed")
+	}
+
+	datastore, host := choosePlacement(mdatastores, hosts, datastorePattern)
+	if datastore == nil {
+		return placement, errors.Errorf("no datastores in cluster match %q and are accessible from an available host", datastorePattern)
+	}
+
+	datastoreElement, err := c.finder.Element(ctx, datastore.Reference())
+	if err != nil {
+		return placement, errors.Wrap(err, "finding the datastore's inventory path failed")
+	}
+
+	poolElement, err := c.finder.Element(ctx, *mcluster.ResourcePool)
+	if err != nil {
+		return placement, errors.Wrap(err, "finding the resource pool's inventory path failed")
+	}
+
+	placement.DatastorePath = datastoreElement.Path
+	placement.DatastoreFreeSpace = datastore.Summary.FreeSpace
+	placement.ResourcePoolPath = poolElement.Path
+	placement.HostPath = path.Join(cluster.InventoryPath, host.Name)
+
+	return placement, nil
+}
+
+// availablePlacementHosts returns the hosts that are connected and aren't in
+// maintenance mode, sorted by name.
+func availablePlacementHosts(hosts []mo.HostSystem) []mo.HostSystem {
+	var available []mo.HostSystem
+	for _, host := range hosts {
+		if host.Runtime.ConnectionState != types.HostSystemConnectionStateConnected || host.Runtime.InMaintenanceMode {
+			continue
+		}
+		available = append(available, host)
+	}
+
+	sort.Slice(available, func(i, j int) bool { return available[i].Name < available[j].Name })
+	return available
+}
+
+// choosePlacement returns the datastore with the most free space out of the
+// ones with names matching pattern that are accessible from one of the hosts,
+// along with the first of the hosts it is accessible from. It returns nils if
+// there is no such datastore.
+func choosePlacement(datastores []mo.Datastore, hosts []mo.HostSystem, pattern string) (*mo.Datastore, *mo.HostSystem) {
+	var chosenDatastore *mo.Datastore
+	var chosenHost *mo.HostSystem
+	for i := range datastores {
+		datastore := &datastores[i]
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, datastore.Name); !ok {
+				continue
+			}
+		}
+
+		host := firstHostWithAccess(datastore, hosts)
+		if host == nil {
+			continue
+		}
+
+		if chosenDatastore == nil || datastore.Summary.FreeSpace > chosenDatastore.Summary.FreeSpace {
+			chosenDatastore = datastore
+			chosenHost = host
+		}
+	}
+
+	return chosenDatastore, chosenHost
+}
+
+// firstHostWithAccess returns the first of the hosts that has the datastore
+// mounted and accessible, or nil if there are none.
+func firstHostWithAccess(datastore *mo.Datastore, hosts []mo.HostSystem) *mo.HostSystem {
+	for i := range hosts {
+		for _, mount := range datastore.Host {
+			if mount.Key != hosts[i].Reference() {
+				continue
+			}
+
+			mounted := mount.MountInfo.Mounted == nil || *mount.MountInfo.Mounted
+			accessible := mount.MountInfo.Accessible == nil || *mount.MountInfo.Accessible
+			if mounted && accessible {
+				return &hosts[i]
+			}
+		}
+	}
+
+	return nil
+}
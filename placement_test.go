@@ -0,0 +1,123 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestPlaceImage(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	placement, err := PlaceImage(ctx, service.URL(), false, "/DC0/host/DC0_C0", "LocalDS_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if placement.DatastorePath != "/DC0/datastore/LocalDS_0" {
+		t.Errorf("unexpected datastore %s", placement.DatastorePath)
+	}
+	if placement.ResourcePoolPath != "/DC0/host/DC0_C0/Resources" {
+		t.Errorf("unexpected resource pool %s", placement.ResourcePoolPath)
+	}
+	if !strings.HasPrefix(placement.HostPath, "/DC0/host/DC0_C0/DC0_C0_H") {
+		t.Errorf("unexpected host %s", placement.HostPath)
+	}
+}
+
+func TestPlaceImageNoMatchingDatastore(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	_, err = PlaceImage(ctx, service.URL(), false, "/DC0/host/DC0_C0", "nfs-*")
+	if err == nil {
+		t.Fatal("expected error placing image, but none occurred")
+	}
+	if !strings.Contains(err.Error(), `no datastores in cluster match "nfs-*"`) {
+		t.Fatal(err)
+	}
+}
+
+func TestChoosePlacement(t *testing.T) {
+	host := func(value, name string, state types.HostSystemConnectionState, maintenance bool) mo.HostSystem {
+		var h mo.HostSystem
+		h.Self = types.ManagedObjectReference{Type: "HostSystem", Value: value}
+		h.Name = name
+		h.Runtime.ConnectionState = state
+		h.Runtime.InMaintenanceMode = maintenance
+		return h
+	}
+	datastore := func(name string, freeSpace int64, hosts ...string) mo.Datastore {
+		var ds mo.Datastore
+		ds.Name = name
+		ds.Summary.FreeSpace = freeSpace
+		for _, h := range hosts {
+			ds.Host = append(ds.Host, types.DatastoreHostMount{
+				Key: types.ManagedObjectReference{Type: "HostSystem", Value: h},
+			})
+		}
+		return ds
+	}
+
+	hosts := availablePlacementHosts([]mo.HostSystem{
+		host("host-1", "esx-c", types.HostSystemConnectionStateConnected, false),
+		host("host-2", "esx-a", types.HostSystemConnectionStateConnected, true),
+		host("host-3", "esx-b", types.HostSystemConnectionStateDisconnected, false),
+		host("host-4", "esx-d", types.HostSystemConnectionStateConnected, false),
+	})
+	if len(hosts) != 2 || hosts[0].Name != "esx-c" || hosts[1].Name != "esx-d" {
+		t.Fatalf("unexpected available hosts %v", hosts)
+	}
+
+	datastores := []mo.Datastore{
+		datastore("ssd-1", 100, "host-1", "host-4"),
+		datastore("ssd-2", 300, "host-2", "host-3"),
+		datastore("ssd-3", 200, "host-4"),
+		datastore("hdd-1", 1000, "host-1"),
+	}
+
+	ds, h := choosePlacement(datastores, hosts, "ssd-*")
+	if ds == nil || ds.Name != "ssd-3" || h.Name != "esx-d" {
+		t.Fatalf("expected ssd-3 on esx-d, got %v and %v", ds, h)
+	}
+
+	ds, h = choosePlacement(datastores, hosts, "")
+	if ds == nil || ds.Name != "hdd-1" || h.Name != "esx-c" {
+		t.Fatalf("expected hdd-1 on esx-c, got %v and %v", ds, h)
+	}
+
+	if ds, _ = choosePlacement(datastores, hosts, "nfs-*"); ds != nil {
+		t.Fatalf("expected no datastore, got %s", ds.Name)
+	}
+}
+
+func TestNeedsPlacement(t *testing.T) {
+	tests := []struct {
+		destination ImageDestination
+		expected    bool
+	}{
+		{destination: ImageDestination{}},
+		{destination: ImageDestination{DatastorePath: "/DC0/datastore/LocalDS_0"}},
+		{destination: ImageDestination{ClusterPath: "/DC0/host/DC0_C0"}, expected: true},
+		{destination: ImageDestination{ClusterPath: "/DC0/host/DC0_C0", DatastorePath: "/DC0/datastore/LocalDS_0", ResourcePoolPath: "/DC0/host/DC0_C0/Resources"}, expected: true},
+		{destination: ImageDestination{ClusterPath: "/DC0/host/DC0_C0", DatastorePath: "/DC0/datastore/LocalDS_0", ResourcePoolPath: "/DC0/host/DC0_C0/Resources", HostPath: "/DC0/host/DC0_C0/DC0_C0_H0"}},
+	}
+
+	for _, test := range tests {
+		if got := test.destination.NeedsPlacement(); got != test.expected {
+			t.Errorf("expected NeedsPlacement of %+v to be %v, got %v", test.destination, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package vsphereimages
+
+import (
+	"context"
+	"sync"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Action is one of the changes an operation makes in vSphere, such as running
+// a task.
+type Action struct {
+	// Step says what the action is for, in the same words that progress and
+	// retries are reported with, e.g. "renaming the VM to foo".
+	Step string
+
+	// Method is the vSphere API method that is called, e.g.
+	// "Reconfigure_Task".
+	Method string
+
+	// Object is the inventory or datastore path of what the action is taken
+	// on, e.g. the VM that is renamed.
+	Object string
+
+	// Target is where the object ends up, for actions that clone, move or
+	// rename it, e.g. the folder a VM is moved into.
+	Target string
+}
+
+// Plan is the list of actions an operation would take, in the order it would
+// take them. See WithPlan.
+type Plan struct {
+	mutex   sync.Mutex
+	actions []Action
+}
+
+// Actions returns the actions that were planned.
+func (p *Plan) Actions() []Action {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]Action(nil), p.actions...)
+}
+
+func (p *Plan) add(action Action) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.actions = append(p.actions, action)
+}
+
+type planKey struct{}
+
+// WithPlan returns a copy of ctx that makes the operations it is passed to
+// plan what they would do, without changing anything. Every object is looked
+// up as usual, and an operation that would fail before making its first
+// change still fails, but the actions that would change something are added
+// to plan instead of being taken. Read-only tasks, such as searching a
+// datastore, are still run.
+func WithPlan(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, planKey{}, plan)
+}
+
+// planFrom returns the plan of ctx, or nil if it doesn't have one.
+func planFrom(ctx context.Context) *Plan {
+	plan, _ := ctx.Value(planKey{}).(*Plan)
+	return plan
+}
+
+// planned adds action to the plan of ctx and returns true if ctx has one, in
+// which case the action must not be taken.
+func planned(ctx context.Context, action Action) bool {
+	plan := planFrom(ctx)
+	if plan == nil {
+		return false
+	}
+
+	plan.add(action)
+	return true
+}
+
+// runTask runs f, which runs the vSphere task for action, with retries (see
+// retry). If ctx has a plan, the action is added to it instead.
+func (c *Client) runTask(ctx context.Context, action Action, s progress.Sinker, f func(progress.Sinker) error) error {
+	if planned(ctx, action) {
+		return nil
+	}
+
+	return c.retry(ctx, action.Step, s, f)
+}
+
+// findCreatedImage finds the VM at vmPath, which an earlier step created. If
+// ctx has a plan, that step was only planned, so a VM with nothing but its
+// inventory path set is returned, for planning the steps that come after.
+func (c *Client) findCreatedImage(ctx context.Context, vmPath string) (*object.VirtualMachine, error) {
+	if planFrom(ctx) == nil {
+		return c.finder.VirtualMachine(ctx, vmPath)
+	}
+
+	vm := object.NewVirtualMachine(c.client.Client, types.ManagedObjectReference{Type: "VirtualMachine"})
+	vm.InventoryPath = vmPath
+	return vm, nil
+}
@@ -0,0 +1,167 @@
+package vsphereimages
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPlanMoveImage(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "test_folder"); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := &Plan{}
+	err = MoveImage(WithPlan(ctx, plan), service.URL(), false, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/test_folder", "my_renamed_vm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Action{
+		{Step: "renaming the VM", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM0", Target: "/DC0/vm/my_renamed_vm"},
+		{Step: "moving the VM", Method: "MoveIntoFolder_Task", Object: "/DC0/vm/my_renamed_vm", Target: "/DC0/vm/test_folder"},
+	}
+	if !reflect.DeepEqual(plan.Actions(), expected) {
+		t.Fatalf("expected actions %+v, got %+v", expected, plan.Actions())
+	}
+
+	finder, err := service.NewFinder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0"); err != nil {
+		t.Fatalf("expected the VM to be left alone, got %v", err)
+	}
+}
+
+func TestPlanCopyImageReplace(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	destination := simulatorCopyDestination(service, "DC0_H0_VM1")
+	destination.OnConflict = ConflictReplace
+
+	plan := &Plan{}
+	if err = CopyImage(WithPlan(ctx, plan), source, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Action{
+		{Step: "cloning DC0_H0_VM1-replacing", Method: "CloneVM_Task", Object: "/DC0/vm/DC0_H0_VM0", Target: "/DC0/vm/DC0_H0_VM1-replacing"},
+		{Step: "renaming the VM to DC0_H0_VM1-old", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM1", Target: "/DC0/vm/DC0_H0_VM1-old"},
+		{Step: "renaming the VM to DC0_H0_VM1", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM1-replacing", Target: "/DC0/vm/DC0_H0_VM1"},
+	}
+	if !reflect.DeepEqual(plan.Actions(), expected) {
+		t.Fatalf("expected actions %+v, got %+v", expected, plan.Actions())
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	if vm, err := client.findImageIfExists(ctx, "/DC0/vm/DC0_H0_VM1-replacing"); err != nil || vm != nil {
+		t.Fatalf("expected nothing to be copied, got %v, %v", vm, err)
+	}
+}
+
+func TestPlanRollbackImage(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	if err = client.SnapshotImage(ctx, "/DC0/vm/DC0_H0_VM1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-old", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := &Plan{}
+	if err = client.RollbackImage(WithPlan(ctx, plan), "/DC0/vm/DC0_H0_VM0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Action{
+		{Step: "renaming the VM to DC0_H0_VM0-rollback", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM0", Target: "/DC0/vm/DC0_H0_VM0-rollback"},
+		{Step: "renaming the VM to DC0_H0_VM0", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM0-old", Target: "/DC0/vm/DC0_H0_VM0"},
+		{Step: "renaming the VM to DC0_H0_VM0-old", Method: "Reconfigure_Task", Object: "/DC0/vm/DC0_H0_VM0-rollback", Target: "/DC0/vm/DC0_H0_VM0-old"},
+	}
+	if !reflect.DeepEqual(plan.Actions(), expected) {
+		t.Fatalf("expected actions %+v, got %+v", expected, plan.Actions())
+	}
+
+	if vm, err := client.findImageIfExists(ctx, "/DC0/vm/DC0_H0_VM0-rollback"); err != nil || vm != nil {
+		t.Fatalf("expected nothing to be renamed, got %v, %v", vm, err)
+	}
+}
+
+func TestPlanCheckOutSelectedHost(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createCluster(ctx, service, "/DC0/host", "dedicated"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	host, err := client.finder.HostSystem(ctx, "/DC0/host/DC0_C0/DC0_C0_H0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the simulator can't move hosts into clusters, so this only works if
+	// nothing is done
+	plan := &Plan{}
+	if err = client.CheckOutSelectedHost(WithPlan(ctx, plan), host, "/DC0/host/dedicated", CheckOutOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Action{
+		{Step: "entering maintenance mode", Method: "EnterMaintenanceMode_Task", Object: "/DC0/host/DC0_C0/DC0_C0_H0"},
+		{Step: "moving the host to the destination cluster", Method: "MoveInto_Task", Object: "/DC0/host/DC0_C0/DC0_C0_H0", Target: "/DC0/host/dedicated"},
+		{Step: "exiting maintenance mode", Method: "ExitMaintenanceMode_Task", Object: "/DC0/host/DC0_C0/DC0_C0_H0"},
+	}
+	if !reflect.DeepEqual(plan.Actions(), expected) {
+		t.Fatalf("expected actions %+v, got %+v", expected, plan.Actions())
+	}
+
+	inMaintenanceMode, err := isHostInMaintenanceMode(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inMaintenanceMode {
+		t.Fatal("expected the host to be left alone")
+	}
+}
@@ -0,0 +1,48 @@
+package vsphereimages
+
+import (
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// StepSinker is a progress.Sinker that is also told when an operation that
+// runs several vSphere tasks, such as RestoreBackup, moves on to its next
+// step. Without it, the progress of each task starts over from 0% with no
+// way of telling which task it is for.
+//
+// Every function that takes a progress.Sinker checks whether it is a
+// StepSinker, so plain Sinkers keep working as before.
+type StepSinker interface {
+	progress.Sinker
+
+	// Step is called when a step starts, before any progress is reported for
+	// it. number counts from 1 up to total, and name says what the step
+	// does, e.g. "removing snapshots".
+	Step(number int, total int, name string)
+}
+
+// stepSinker counts the steps of an operation for a StepSinker.
+type stepSinker struct {
+	StepSinker
+	number int
+	total  int
+}
+
+// withSteps returns a sinker that reports the steps of an operation with
+// total steps to s, if s is a StepSinker. Otherwise s is returned as-is.
+func withSteps(s progress.Sinker, total int) progress.Sinker {
+	stepper, ok := s.(StepSinker)
+	if !ok {
+		return s
+	}
+
+	return &stepSinker{StepSinker: stepper, total: total}
+}
+
+// nextStep reports that the next step, called name, is starting, if s was
+// returned by withSteps for a StepSinker.
+func nextStep(s progress.Sinker, name string) {
+	if steps, ok := s.(*stepSinker); ok {
+		steps.number++
+		steps.Step(steps.number, steps.total, name)
+	}
+}
@@ -0,0 +1,86 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// stepRecorder is a StepSinker that records the steps it is told about.
+type stepRecorder struct {
+	steps []string
+}
+
+func (r *stepRecorder) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	go func() {
+		for range ch {
+		}
+	}()
+	return ch
+}
+
+func (r *stepRecorder) Step(number int, total int, name string) {
+	r.steps = append(r.steps, fmt.Sprintf("%d/%d %s", number, total, name))
+}
+
+func TestRestoreBackupSteps(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	backupPath, err := client.CreateBackup(ctx, "/DC0/vm/DC0_H0_VM0", "/DC0/vm/backups", "", BackupOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &stepRecorder{}
+	if err = client.RestoreBackup(ctx, backupPath, "/DC0/vm", "", "", false, BackupOptions{}, recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"1/5 cloning the backup to DC0_H0_VM0-restoring",
+		"2/5 removing snapshots",
+		"3/5 creating the base snapshot",
+		"4/5 renaming DC0_H0_VM0 to DC0_H0_VM0-old",
+		"5/5 renaming DC0_H0_VM0-restoring to DC0_H0_VM0",
+	}
+	if !reflect.DeepEqual(recorder.steps, expected) {
+		t.Fatalf("expected steps %q, got %q", expected, recorder.steps)
+	}
+}
+
+func TestSnapshotImageSteps(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	recorder := &stepRecorder{}
+	if err = SnapshotImage(context.TODO(), service.URL(), false, "/DC0/vm/DC0_H0_VM0", recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"1/2 removing snapshots", "2/2 creating the base snapshot"}
+	if !reflect.DeepEqual(recorder.steps, expected) {
+		t.Fatalf("expected steps %q, got %q", expected, recorder.steps)
+	}
+}
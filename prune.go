@@ -0,0 +1,270 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// restoredFromKey is the extra config key that RestoreBackup uses to record
+// the inventory path of the backup an image was restored from.
+const restoredFromKey = "vsphereimages.restoredFrom"
+
+// RetentionPolicy describes which backups PruneBackups keeps. A backup is kept
+// if any part of the policy says it should be kept.
+type RetentionPolicy struct {
+	// KeepLast is the number of most recent backups of each image to keep.
+	KeepLast int
+
+	// KeepDailyFor is how long to keep the most recent backup of each day for.
+	KeepDailyFor time.Duration
+
+	// KeepWeeklyFor is how long to keep the most recent backup of each week
+	// for. Weeks start on Monday.
+	KeepWeeklyFor time.Duration
+}
+
+// BackupDecision is what PruneBackups decided to do with a single backup.
+type BackupDecision struct {
+	// Path is the inventory path to the backup.
+	Path string `json:"path"`
+
+	// Image is the name of the image that the backup was taken of.
+	Image string `json:"image"`
+
+	// Timestamp is the time the backup was taken.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Keep is true if the backup is kept, and false if it is destroyed.
+	Keep bool `json:"keep"`
+
+	// Reason explains why the backup is kept. It is empty for backups that
+	// are destroyed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// PruneBackups destroys the backups in backupFolderPath that aren't kept by
+// the retention policy. Backups that an image in imageFolderPath was restored
+// from are always kept. VMs in the backup folder with names that don't look
+// like the ones given by CreateBackup are left alone.
+//
+// If dryRun is true, nothing is destroyed. The decision made for every backup
+// is returned either way, ordered by image name and then newest first.
+func PruneBackups(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, backupFolderPath string, imageFolderPath string, policy RetentionPolicy, dryRun bool, s progress.Sinker) ([]BackupDecision, error) {
+	var decisions []BackupDecision
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		decisions, err = c.PruneBackups(ctx, backupFolderPath, imageFolderPath, policy, dryRun, s)
+		return err
+	})
+	return decisions, err
+}
+
+// PruneBackups destroys the backups in backupFolderPath that aren't kept by
+// the retention policy. See the PruneBackups function for details.
+func (c *Client) PruneBackups(ctx context.Context, backupFolderPath string, imageFolderPath string, policy RetentionPolicy, dryRun bool, s progress.Sinker) ([]BackupDecision, error) {
+	vms, err := c.listFolderImages(ctx, backupFolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing backups failed")
+	}
+
+	images, err := c.listFolderImages(ctx, imageFolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing images failed")
+	}
+
+	restoredFrom, err := c.restoredFromPaths(ctx, images)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding the backups images were restored from failed")
+	}
+
+	var backups []BackupDecision
+	backupVMs := make(map[string]*object.VirtualMachine)
+	for _, vm := range vms {
+		image, timestamp, ok := parseBackupName(vm.Name())
+		if !ok {
+			continue
+		}
+
+		backups = append(backups, BackupDecision{
+			Path:      vm.InventoryPath,
+			Image:     image,
+			Timestamp: timestamp,
+		})
+		backupVMs[vm.InventoryPath] = vm
+	}
+
+	decisions := planBackupPrune(backups, restoredFrom, policy, time.Now())
+	if dryRun {
+		return decisions, nil
+	}
+
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+
+		vm := backupVMs[decision.Path]
+		err = c.runTask(ctx, Action{Step: "destroying " + decision.Path, Method: "Destroy_Task", Object: decision.Path}, s, func(s progress.Sinker) error {
+			task, err := vm.Destroy(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "creating task to destroy %s failed", decision.Path)
+			}
+
+			_, err = waitForTask(ctx, task, s)
+			return errors.Wrapf(err, "destroying %s failed", decision.Path)
+		})
+		if err != nil {
+			return decisions, err
+		}
+	}
+
+	return decisions, nil
+}
+
+// listFolderImages works like ListImages, but returns no VMs instead of an
+// error if the folder exists but is empty.
+func (c *Client) listFolderImages(ctx context.Context, folderPath string) ([]*object.VirtualMachine, error) {
+	if _, err := c.finder.Folder(ctx, folderPath); err != nil {
+		return nil, errors.Wrap(err, "finding the folder failed")
+	}
+
+	vms, err := c.ListImages(ctx, folderPath)
+	if _, ok := errors.Cause(err).(*find.NotFoundError); ok {
+		return nil, nil
+	}
+
+	return vms, err
+}
+
+// restoredFromPaths returns the set of backup paths that the given images
+// were restored from.
+func (c *Client) restoredFromPaths(ctx context.Context, images []*object.VirtualMachine) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	if len(images) == 0 {
+		return paths, nil
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(images))
+	for _, image := range images {
+		refs = append(refs, image.Reference())
+	}
+
+	var mvms []mo.VirtualMachine
+	if err := c.client.Retrieve(ctx, refs, []string{"config.extraConfig"}, &mvms); err != nil {
+		return nil, err
+	}
+
+	for _, mvm := range mvms {
+		if path := restoredFromValue(mvm); path != "" {
+			paths[path] = true
+		}
+	}
+
+	return paths, nil
+}
+
+// imageRestoredFrom returns the inventory path of the backup a VM was restored
+// from, or an empty string if it wasn't restored from a backup.
+func imageRestoredFrom(ctx context.Context, vm *object.VirtualMachine) (string, error) {
+	var mvm mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.extraConfig"}, &mvm); err != nil {
+		return "", err
+	}
+
+	return restoredFromValue(mvm), nil
+}
+
+func restoredFromValue(mvm mo.VirtualMachine) string {
+	if mvm.Config == nil {
+		return ""
+	}
+
+	for _, option := range mvm.Config.ExtraConfig {
+		value := option.GetOptionValue()
+		if value.Key != restoredFromKey {
+			continue
+		}
+
+		if path, ok := value.Value.(string); ok {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// planBackupPrune decides which backups to keep. The backups are sorted by
+// image name and then newest first.
+func planBackupPrune(backups []BackupDecision, restoredFrom map[string]bool, policy RetentionPolicy, now time.Time) []BackupDecision {
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Image != backups[j].Image {
+			return backups[i].Image < backups[j].Image
+		}
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+
+	var image string
+	var count int
+	var days, weeks map[string]bool
+
+	for i := range backups {
+		backup := &backups[i]
+
+		if backup.Image != image {
+			image = backup.Image
+			count = 0
+			days = make(map[string]bool)
+			weeks = make(map[string]bool)
+		}
+		count++
+
+		age := now.Sub(backup.Timestamp)
+		day := backup.Timestamp.Format("2006-01-02")
+		year, week := backup.Timestamp.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+
+		switch {
+		case restoredFrom[backup.Path]:
+			backup.Reason = "an image was restored from it"
+		case count <= policy.KeepLast:
+			backup.Reason = "one of the last backups"
+		case age <= policy.KeepDailyFor && !days[day]:
+			backup.Reason = "daily backup"
+		case age <= policy.KeepWeeklyFor && !weeks[weekKey]:
+			backup.Reason = "weekly backup"
+		}
+
+		backup.Keep = backup.Reason != ""
+		days[day] = true
+		weeks[weekKey] = true
+	}
+
+	return backups
+}
+
+// parseBackupName splits the name of a backup made by CreateBackup into the
+// name of the image and the time the backup was taken.
+func parseBackupName(name string) (string, time.Time, bool) {
+	i := len(name) - len(backupTimestampLayout) - 1
+	if i < 1 || !strings.HasPrefix(name[i:], "-") {
+		return "", time.Time{}, false
+	}
+
+	timestamp, err := time.Parse(backupTimestampLayout, name[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return name[:i], timestamp, true
+}
@@ -0,0 +1,164 @@
+package vsphereimages
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestParseBackupName(t *testing.T) {
+	image, timestamp, ok := parseBackupName("travis-ci-trusty-20170102-150405")
+	if !ok {
+		t.Fatal("expected backup name to be parsed")
+	}
+	if image != "travis-ci-trusty" {
+		t.Fatalf("unexpected image name %s", image)
+	}
+	if !timestamp.Equal(time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected timestamp %v", timestamp)
+	}
+
+	for _, name := range []string{"travis-ci-trusty", "-20170102-150405", "travis-ci-trusty-old"} {
+		if _, _, ok := parseBackupName(name); ok {
+			t.Fatalf("expected %s not to be parsed as a backup name", name)
+		}
+	}
+}
+
+func TestPlanBackupPrune(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	backup := func(image string, age time.Duration) BackupDecision {
+		timestamp := now.Add(-age)
+		return BackupDecision{
+			Path:      "/DC0/vm/backups/" + backupName(image, timestamp),
+			Image:     image,
+			Timestamp: timestamp,
+		}
+	}
+
+	day := 24 * time.Hour
+	backups := []BackupDecision{
+		backup("a", 1*time.Hour),
+		backup("a", 2*time.Hour),
+		backup("a", 1*day),
+		backup("a", 1*day+time.Hour),
+		backup("a", 10*day),
+		backup("a", 40*day),
+		backup("b", 50*day),
+	}
+	restoredFrom := map[string]bool{backups[5].Path: true}
+
+	decisions := planBackupPrune(backups, restoredFrom, RetentionPolicy{
+		KeepLast:      1,
+		KeepDailyFor:  7 * day,
+		KeepWeeklyFor: 30 * day,
+	}, now)
+
+	expected := []bool{true, false, true, false, true, true, true}
+	for i, decision := range decisions {
+		if decision.Keep != expected[i] {
+			t.Errorf("expected keep=%v for %s, got keep=%v (%s)", expected[i], decision.Path, decision.Keep, decision.Reason)
+		}
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	if err = createFolder(ctx, service, "/DC0/vm", "backups"); err != nil {
+		t.Fatal(err)
+	}
+	if err = createFolder(ctx, service, "/DC0/vm", "images"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+
+	now := time.Now()
+	for i, vmPath := range []string{"/DC0/vm/DC0_H0_VM0", "/DC0/vm/DC0_H0_VM1", "/DC0/vm/DC0_C0_RP0_VM0"} {
+		vm, err := client.finder.VirtualMachine(ctx, vmPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task, err := vm.PowerOff(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		name := backupName("image", now.Add(time.Duration(-i)*time.Hour))
+		if err = client.MoveImage(ctx, vmPath, "/DC0/vm/backups", name, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restoredFromPath := "/DC0/vm/backups/" + backupName("image", now.Add(-2*time.Hour))
+	image, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_C0_RP0_VM1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := image.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: restoredFromKey, Value: restoredFromPath},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_C0_RP0_VM1", "/DC0/vm/images", "image", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := RetentionPolicy{KeepLast: 1}
+	decisions, err := client.PruneBackups(ctx, "/DC0/vm/backups", "/DC0/vm/images", policy, true, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 3 {
+		t.Fatalf("expected 3 decisions, got %d", len(decisions))
+	}
+
+	vms, err := client.ListImages(ctx, "/DC0/vm/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 3 {
+		t.Fatalf("expected dry run to keep 3 backups, got %d", len(vms))
+	}
+
+	if _, err = client.PruneBackups(ctx, "/DC0/vm/backups", "/DC0/vm/images", policy, false, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	vms, err = client.ListImages(ctx, "/DC0/vm/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 2 {
+		t.Fatalf("expected 2 backups to be kept, got %d", len(vms))
+	}
+	for _, vm := range vms {
+		if vm.Name() == backupName("image", now.Add(-time.Hour)) {
+			t.Fatalf("expected %s to be destroyed", vm.InventoryPath)
+		}
+	}
+}
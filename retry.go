@@ -0,0 +1,213 @@
+package vsphereimages
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// RetryPolicy says how often a step that fails because of a transient fault
+// is tried again, and how long to wait in between. See IsRetryable for which
+// faults are transient.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a step is tried in total. With 1 or
+	// less, steps aren't retried.
+	MaxAttempts int
+
+	// InitialDelay is how long to wait before the first retry. Every retry
+	// after that waits Multiplier times as long as the one before, up to
+	// MaxDelay.
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of new clients. Changing it changes
+// the policy of the clients created afterwards, including the ones created
+// by the package-level functions.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 2 * time.Second,
+	Multiplier:   2,
+	MaxDelay:     time.Minute,
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < retry; i++ {
+		delay = time.Duration(float64(delay) * p.Multiplier)
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			break
+		}
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// IsRetryable returns whether err is caused by a transient fault, which is
+// likely to go away if the step that failed is tried again:
+//
+//   - TaskInProgress, when another task is still running on the same object
+//   - InvalidState, such as while DRS is moving a VM
+//   - ConcurrentAccess, when an object was changed by someone else meanwhile
+//   - HostCommunication, when vCenter briefly lost contact with a host
+//   - NotAuthenticated, when the session has expired and logging in again
+//     didn't work yet, e.g. while vpxd restarts
+//   - an HTTP 503 Service Unavailable response, e.g. while vpxd restarts
+//
+// Subtypes of these faults, such as InvalidPowerState, aren't transient.
+func IsRetryable(err error) bool {
+	if faultErr, ok := AsFault(err); ok {
+		return isRetryableFault(faultErr.Fault)
+	}
+
+	err = errors.Cause(err)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusServiceUnavailable
+}
+
+func isRetryableFault(fault interface{}) bool {
+	switch fault.(type) {
+	case types.TaskInProgress, *types.TaskInProgress,
+		types.InvalidState, *types.InvalidState,
+		types.ConcurrentAccess, *types.ConcurrentAccess,
+		types.HostCommunication, *types.HostCommunication,
+		types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+
+	return false
+}
+
+// RetrySinker is a progress.Sinker that is also told when a step is tried
+// again after a transient fault. Every function that takes a progress.Sinker
+// checks whether it is a RetrySinker, so plain Sinkers keep working as
+// before.
+type RetrySinker interface {
+	progress.Sinker
+
+	// Retry is called before waiting to try a step again. name says what
+	// the step does, attempt counts the attempts from 1 up to maxAttempts,
+	// and err is what the previous attempt failed with.
+	Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error)
+}
+
+// reportRetry tells s that a step is being retried, if s is a RetrySinker.
+func reportRetry(s progress.Sinker, name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+	if steps, ok := s.(*stepSinker); ok {
+		s = steps.StepSinker
+	}
+
+	if retrier, ok := s.(RetrySinker); ok {
+		retrier.Retry(name, attempt, maxAttempts, delay, err)
+	}
+}
+
+// retry runs f, which runs the vSphere task for the step called name, and
+// runs it again if it fails because of a transient fault, according to
+// c.RetryPolicy.
+//
+// f reports the task's progress to the sinker it is given, which passes it on
+// to s. The error an attempt fails with is only passed on if the step isn't
+// retried, so that the step doesn't look like it failed for good.
+func (c *Client) retry(ctx context.Context, name string, s progress.Sinker, f func(progress.Sinker) error) error {
+	for attempt := 1; ; attempt++ {
+		var err error
+		var retrying bool
+		if s == nil {
+			err = f(nil)
+			retrying = c.shouldRetry(ctx, attempt, err)
+		} else {
+			attemptSinker := &attemptSinker{s: s}
+			err = f(attemptSinker)
+			retrying = c.shouldRetry(ctx, attempt, err)
+			attemptSinker.finish(!retrying)
+		}
+
+		if !retrying {
+			return err
+		}
+
+		delay := c.RetryPolicy.delay(attempt)
+		reportRetry(s, name, attempt+1, c.RetryPolicy.MaxAttempts, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *Client) shouldRetry(ctx context.Context, attempt int, err error) bool {
+	return err != nil && ctx.Err() == nil && attempt < c.RetryPolicy.MaxAttempts && IsRetryable(err)
+}
+
+// attemptSinker passes on the progress of an attempt at a step to s, except
+// for the errors the attempt failed with, which are held back until it is
+// known whether the step is tried again.
+type attemptSinker struct {
+	s  progress.Sinker
+	wg sync.WaitGroup
+
+	mutex sync.Mutex
+	sinks []*attemptSink
+}
+
+// attemptSink is a sink of s, along with the error that was held back from it.
+type attemptSink struct {
+	ch      chan<- progress.Report
+	failure progress.Report
+}
+
+func (a *attemptSinker) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	sink := &attemptSink{ch: a.s.Sink()}
+
+	a.mutex.Lock()
+	a.sinks = append(a.sinks, sink)
+	a.mutex.Unlock()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		for r := range ch {
+			if r.Error() != nil {
+				sink.failure = r
+				continue
+			}
+
+			sink.ch <- r
+		}
+	}()
+
+	return ch
+}
+
+// finish closes the sinks of the attempt once all of its progress has been
+// passed on. The errors it failed with are passed on first if final is true.
+func (a *attemptSinker) finish(final bool) {
+	a.wg.Wait()
+
+	for _, sink := range a.sinks {
+		if final && sink.failure != nil {
+			sink.ch <- sink.failure
+		}
+		close(sink.ch)
+	}
+}
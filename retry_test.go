@@ -0,0 +1,214 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: nil, retryable: false},
+		{err: errors.New("something broke"), retryable: false},
+		{err: &url.Error{Op: "Post", URL: "https://vcenter/sdk", Err: &StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}}, retryable: true},
+		{err: errors.Wrap(&StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, "creating clone task failed"), retryable: true},
+		{err: &StatusError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}, retryable: false},
+		{err: errors.New("503 Service Unavailable"), retryable: false},
+		{err: errors.New("404 Not Found"), retryable: false},
+		{err: taskError(&types.TaskInProgress{}), retryable: true},
+		{err: taskError(&types.InvalidState{}), retryable: true},
+		{err: taskError(&types.InvalidPowerState{}), retryable: false},
+		{err: taskError(&types.DuplicateName{}), retryable: false},
+		{err: errors.Wrap(taskError(&types.ConcurrentAccess{}), "renaming VM failed"), retryable: true},
+		{err: soap.WrapVimFault(&types.HostCommunication{}), retryable: true},
+		{err: soap.WrapSoapFault(&soap.Fault{Detail: struct {
+			Fault types.AnyType `xml:",any,typeattr"`
+		}{Fault: types.NotAuthenticated{}}}), retryable: true},
+	}
+
+	for _, test := range tests {
+		if retryable := IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("expected IsRetryable(%#v) to be %v", test.err, test.retryable)
+		}
+	}
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewClient(context.TODO(), u, false)
+	if !IsRetryable(err) {
+		t.Fatalf("expected a 503 response to be retryable, got %v", err)
+	}
+}
+
+func taskError(fault types.BaseMethodFault) error {
+	return task.Error{LocalizedMethodFault: &types.LocalizedMethodFault{Fault: fault}}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+
+	var delays []time.Duration
+	for retry := 1; retry <= 4; retry++ {
+		delays = append(delays, policy.delay(retry))
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Fatalf("expected delays %v, got %v", expected, delays)
+	}
+}
+
+// retryRecorder is a RetrySinker that records the retries and the progress
+// reports it is told about.
+type retryRecorder struct {
+	mutex   sync.Mutex
+	reports []string
+	retries []string
+}
+
+func (r *retryRecorder) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	go func() {
+		for report := range ch {
+			r.mutex.Lock()
+			if report.Error() != nil {
+				r.reports = append(r.reports, "error: "+report.Error().Error())
+			} else {
+				r.reports = append(r.reports, fmt.Sprintf("%.0f%%", report.Percentage()))
+			}
+			r.mutex.Unlock()
+		}
+	}()
+	return ch
+}
+
+func (r *retryRecorder) Retry(name string, attempt int, maxAttempts int, delay time.Duration, err error) {
+	r.retries = append(r.retries, fmt.Sprintf("%s %d/%d: %v", name, attempt, maxAttempts, err))
+}
+
+// testReport is a progress.Report for tests.
+type testReport struct {
+	percentage float32
+	err        error
+}
+
+func (r testReport) Percentage() float32 { return r.percentage }
+func (r testReport) Detail() string      { return "" }
+func (r testReport) Error() error        { return r.err }
+
+func TestRetry(t *testing.T) {
+	client := &Client{RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond}}
+	recorder := &retryRecorder{}
+
+	attempts := 0
+	err := client.retry(context.TODO(), "renaming the VM", recorder, func(s progress.Sinker) error {
+		attempts++
+
+		ch := s.Sink()
+		defer close(ch)
+
+		ch <- testReport{percentage: 50}
+		if attempts < 3 {
+			err := taskError(&types.TaskInProgress{})
+			ch <- testReport{err: err}
+			return err
+		}
+		ch <- testReport{percentage: 100}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sinks are closed before retry returns, but the recorder may not
+	// have seen the last report yet
+	time.Sleep(10 * time.Millisecond)
+
+	expectedRetries := []string{
+		"renaming the VM 2/3: " + taskError(&types.TaskInProgress{}).Error(),
+		"renaming the VM 3/3: " + taskError(&types.TaskInProgress{}).Error(),
+	}
+	if !reflect.DeepEqual(recorder.retries, expectedRetries) {
+		t.Fatalf("expected retries %q, got %q", expectedRetries, recorder.retries)
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	expectedReports := []string{"50%", "50%", "50%", "100%"}
+	if !reflect.DeepEqual(recorder.reports, expectedReports) {
+		t.Fatalf("expected the errors of the retried attempts to be held back, got %q", recorder.reports)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	client := &Client{RetryPolicy: RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond}}
+	recorder := &retryRecorder{}
+
+	attempts := 0
+	err := client.retry(context.TODO(), "renaming the VM", recorder, func(s progress.Sinker) error {
+		attempts++
+
+		ch := s.Sink()
+		defer close(ch)
+
+		err := taskError(&types.TaskInProgress{})
+		ch <- testReport{err: err}
+		return err
+	})
+	if !IsRetryable(err) {
+		t.Fatalf("expected the last attempt's error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	expectedReports := []string{"error: " + err.Error()}
+	if !reflect.DeepEqual(recorder.reports, expectedReports) {
+		t.Fatalf("expected only the last attempt's error to be passed on, got %q", recorder.reports)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	client := &Client{RetryPolicy: RetryPolicy{MaxAttempts: 5, InitialDelay: time.Millisecond}}
+
+	attempts := 0
+	err := client.retry(context.TODO(), "powering off", nil, func(s progress.Sinker) error {
+		attempts++
+		return taskError(&types.InvalidPowerState{})
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
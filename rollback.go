@@ -0,0 +1,130 @@
+package vsphereimages
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// oldImageSuffix is appended to the name of an image that has been replaced,
+// e.g. by RestoreBackup.
+const oldImageSuffix = "-old"
+
+// RollbackImage swaps an image with the "-old" image next to it, which is
+// usually left behind by RestoreBackup.
+//
+// The image is first renamed with a "-rollback" suffix, then the old image is
+// renamed to take its place, and finally the image is renamed with the "-old"
+// suffix. If renaming the old image fails, the image is renamed back to its
+// original name. The old image must have a base snapshot.
+func RollbackImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imagePath string, s progress.Sinker) error {
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.RollbackImage(ctx, imagePath, s)
+	})
+}
+
+// RollbackImage swaps an image with the "-old" image next to it. See the
+// RollbackImage function for details.
+func (c *Client) RollbackImage(ctx context.Context, imagePath string, s progress.Sinker) error {
+	image, err := c.finder.VirtualMachine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "finding the VM failed")
+	}
+
+	oldImage, err := c.finder.VirtualMachine(ctx, imagePath+oldImageSuffix)
+	if err != nil {
+		return errors.Wrap(err, "finding the old VM failed")
+	}
+
+	if _, err = oldImage.FindSnapshot(ctx, "base"); err != nil {
+		return errors.Wrap(err, "finding the old VM's base snapshot failed")
+	}
+
+	name := image.Name()
+	rollbackName := name + "-rollback"
+
+	s = withSteps(s, 3)
+
+	nextStep(s, "renaming "+name+" to "+rollbackName)
+	if err = c.renameImage(ctx, image, rollbackName, s); err != nil {
+		return errors.Wrap(err, "renaming VM out of the way failed")
+	}
+
+	nextStep(s, "renaming "+name+oldImageSuffix+" to "+name)
+	if err = c.renameImage(ctx, oldImage, name, s); err != nil {
+		if undoErr := c.renameImage(ctx, image, name, s); undoErr != nil {
+			return errors.Wrapf(err, "renaming old VM failed, and renaming %s back to %s failed too (%v)", rollbackName, name, undoErr)
+		}
+		return errors.Wrap(err, "renaming old VM failed")
+	}
+
+	nextStep(s, "renaming "+rollbackName+" to "+name+oldImageSuffix)
+	if err = c.renameImage(ctx, image, name+oldImageSuffix, s); err != nil {
+		return errors.Wrapf(err, "renaming replaced VM failed, it is still called %s", rollbackName)
+	}
+
+	return nil
+}
+
+// CleanupOldImages destroys the "-old" images in a folder that haven't been
+// modified for at least olderThan. Since renaming an image modifies it, this
+// is usually how long ago the image was replaced.
+//
+// If dryRun is true, nothing is destroyed. The images that are (or would be)
+// destroyed are returned.
+func CleanupOldImages(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, folderPath string, olderThan time.Duration, dryRun bool, s progress.Sinker) ([]ImageInfo, error) {
+	var infos []ImageInfo
+	err := withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		var err error
+		infos, err = c.CleanupOldImages(ctx, folderPath, olderThan, dryRun, s)
+		return err
+	})
+	return infos, err
+}
+
+// CleanupOldImages destroys the "-old" images in a folder that haven't been
+// modified for at least olderThan. See the CleanupOldImages function for
+// details.
+func (c *Client) CleanupOldImages(ctx context.Context, folderPath string, olderThan time.Duration, dryRun bool, s progress.Sinker) ([]ImageInfo, error) {
+	vms, err := c.listFolderImages(ctx, folderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing images failed")
+	}
+
+	infos, err := c.imageInfo(ctx, vms)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting information about the images failed")
+	}
+
+	var destroyed []ImageInfo
+	for i, info := range infos {
+		if !strings.HasSuffix(info.Name, oldImageSuffix) || time.Since(info.Modified) < olderThan {
+			continue
+		}
+
+		destroyed = append(destroyed, info)
+		if dryRun {
+			continue
+		}
+
+		vm := vms[i]
+		err = c.runTask(ctx, Action{Step: "destroying " + info.InventoryPath, Method: "Destroy_Task", Object: info.InventoryPath}, s, func(s progress.Sinker) error {
+			task, err := vm.Destroy(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "creating task to destroy %s failed", info.InventoryPath)
+			}
+
+			_, err = waitForTask(ctx, task, s)
+			return errors.Wrapf(err, "destroying %s failed", info.InventoryPath)
+		})
+		if err != nil {
+			return destroyed, err
+		}
+	}
+
+	return destroyed, nil
+}
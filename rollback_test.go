@@ -0,0 +1,127 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRollbackImage(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = client.SnapshotImage(ctx, "/DC0/vm/DC0_H0_VM1", logger); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-old", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldImage, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.RollbackImage(ctx, "/DC0/vm/DC0_H0_VM0", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	rolledBack, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack.Reference() != oldImage.Reference() {
+		t.Fatal("expected the old VM to be called DC0_H0_VM0 after rolling back")
+	}
+
+	replaced, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Reference() != image.Reference() {
+		t.Fatal("expected the replaced VM to be called DC0_H0_VM0-old after rolling back")
+	}
+}
+
+func TestRollbackImageWithoutBaseSnapshot(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = MoveImage(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-old", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	err = RollbackImage(ctx, service.URL(), false, "/DC0/vm/DC0_H0_VM0", logger)
+	if err == nil {
+		t.Fatal("expected error rolling back image, but none occurred")
+	}
+	if !strings.Contains(err.Error(), "finding the old VM's base snapshot failed") {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupOldImages(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	logger := newProgressLogger()
+	defer logger.Wait()
+	if err = client.MoveImage(ctx, "/DC0/vm/DC0_H0_VM1", "/DC0/vm", "DC0_H0_VM0-old", logger); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	destroyed, err := client.CleanupOldImages(ctx, "/DC0/vm", 0, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destroyed) != 1 || destroyed[0].InventoryPath != "/DC0/vm/DC0_H0_VM0-old" {
+		t.Fatalf("unexpected destroyed images %v", destroyed)
+	}
+
+	if _, err = client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0-old"); err == nil {
+		t.Fatal("expected old VM to be destroyed")
+	}
+}
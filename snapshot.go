@@ -5,39 +5,22 @@ import (
 	"net/url"
 
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/vim25/progress"
 )
 
 func SnapshotImage(ctx context.Context, vSphereEndpoint *url.URL, vSphereInsecureSkipVerify bool, imageInventoryPath string, s progress.Sinker) error {
-	client, err := govmomi.NewClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify)
-	if err != nil {
-		return errors.Wrap(err, "creating vSphere client failed")
-	}
-
-	finder := find.NewFinder(client.Client, false)
+	return withClient(ctx, vSphereEndpoint, vSphereInsecureSkipVerify, func(c *Client) error {
+		return c.SnapshotImage(ctx, imageInventoryPath, s)
+	})
+}
 
-	vm, err := finder.VirtualMachine(ctx, imageInventoryPath)
+func (c *Client) SnapshotImage(ctx context.Context, imageInventoryPath string, s progress.Sinker) error {
+	vm, err := c.finder.VirtualMachine(ctx, imageInventoryPath)
 	if err != nil {
 		return errors.Wrap(err, "finding the VM failed")
 	}
 
-	removeTask, err := vm.RemoveAllSnapshot(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "creating task to remove all snapshots failed")
-	}
-
-	_, err = removeTask.WaitForResult(ctx, s)
-	if err != nil {
-		return errors.Wrap(err, "removing all snapshots failed")
-	}
-
-	createTask, err := vm.CreateSnapshot(ctx, "base", "", false, false)
-	if err != nil {
-		return errors.Wrap(err, "creating task to create snapshot failed")
-	}
+	s = withSteps(s, 2)
 
-	_, err = createTask.WaitForResult(ctx, s)
-	return errors.Wrap(err, "creating snapshot failed")
+	return c.resnapshotImage(ctx, vm, s)
 }
@@ -0,0 +1,89 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// cleanupTimeout is how long cleaning up after a cancelled operation, such as
+// cancelling its task or rolling it back, may take.
+const cleanupTimeout = 5 * time.Minute
+
+// cleanupContext returns the context to clean up after an operation with:
+// ctx itself, unless it is already done, since nothing could be cleaned up
+// with it then. The returned cancel function must be called once the
+// cleanup is done.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// waitForTask waits for the task to finish, reporting its progress to s. If
+// the task fails, the fault it failed with is returned as a *FaultError.
+//
+// If ctx is done first, the task is cancelled on vCenter and waited on until it
+// stops, so that it isn't left running with nobody watching it. An error
+// whose cause is ctx.Err() is returned then, unless the task managed to
+// finish anyway.
+func waitForTask(ctx context.Context, task *object.Task, s progress.Sinker) (*types.TaskInfo, error) {
+	info, err := task.WaitForResult(ctx, s)
+	if ctx.Err() == nil {
+		return info, wrapFault(err)
+	}
+
+	cleanupCtx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	// not every task can be cancelled, and the task may have finished in the
+	// meantime, so any error here is ignored in favour of waiting for it
+	_ = task.Cancel(cleanupCtx)
+
+	if info, err = task.WaitForResult(cleanupCtx, nil); err == nil {
+		return info, nil
+	}
+
+	return nil, errors.Wrap(ctx.Err(), "the task was cancelled")
+}
+
+// TimeoutError is returned when a step of an operation takes longer than the
+// timeout it was given. The step's task is cancelled, and the operation is
+// rolled back like it would be for any other error.
+type TimeoutError struct {
+	// Step says what timed out, e.g. "entering maintenance mode".
+	Step string
+
+	// Timeout is how long the step was allowed to take.
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Step, e.Timeout)
+}
+
+// waitForStep is like waitForTask, but gives up waiting after timeout and
+// returns a *TimeoutError for step, unless timeout is 0. If ctx is done
+// first, its error is returned as usual.
+func waitForStep(ctx context.Context, task *object.Task, step string, timeout time.Duration, s progress.Sinker) (*types.TaskInfo, error) {
+	if timeout <= 0 {
+		return waitForTask(ctx, task, s)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	info, err := waitForTask(stepCtx, task, s)
+	if err != nil && ctx.Err() == nil && stepCtx.Err() == context.DeadlineExceeded {
+		return nil, &TimeoutError{Step: step, Timeout: timeout}
+	}
+
+	return info, err
+}
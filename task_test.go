@@ -0,0 +1,113 @@
+package vsphereimages
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestWaitForTaskCancelled(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	vm, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	// the task finished before it could be cancelled, so it succeeded
+	task, err := vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = waitForTask(cancelledCtx, task, nil); err != nil {
+		t.Fatalf("expected a task that finished anyway to succeed, got %v", err)
+	}
+
+	// powering off a VM that is already off fails
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = waitForTask(cancelledCtx, task, nil)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected the task to be cancelled, got %v", err)
+	}
+}
+
+func TestLogoutAfterCancel(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err = client.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForStepTimeout(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	client, err := NewClient(ctx, service.URL(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout(ctx)
+
+	vm, err := client.finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the task finished before it could be cancelled, so it succeeded
+	task, err := vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = waitForStep(ctx, task, "powering off", time.Nanosecond, nil); err != nil {
+		t.Fatalf("expected a task that finished anyway to succeed, got %v", err)
+	}
+
+	// powering off a VM that is already off fails
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = waitForStep(ctx, task, "powering off", time.Nanosecond, nil)
+	timeoutErr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %v", err)
+	}
+	if timeoutErr.Step != "powering off" {
+		t.Fatalf("expected the step to be \"powering off\", got %q", timeoutErr.Step)
+	}
+}
@@ -0,0 +1,137 @@
+package vsphereimages
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLSOptions controls how the certificate presented by a vSphere API endpoint
+// is verified.
+type TLSOptions struct {
+	// InsecureSkipVerify controls whether the server's certificate chain and
+	// hostname should be verified. If InsecureSkipVerify is true, any
+	// certificate presented by the server and any host name in that
+	// certificate will be accepted. See also
+	// crypto/tls.Config.InsecureSkipVerify.
+	InsecureSkipVerify bool
+
+	// CAFile is the path to a PEM file with the CA certificates to trust,
+	// instead of the system's. More than one file can be given, separated by
+	// the OS's path list separator.
+	CAFile string
+
+	// SHA256Fingerprint pins the server's certificate. If it is set, only a
+	// certificate with this SHA-256 fingerprint is accepted, whatever its
+	// chain and host names are. It should be formatted as a series of
+	// :-separated hexadecimal numbers.
+	SHA256Fingerprint string
+}
+
+// tlsConfig returns the TLS configuration to connect to a server with.
+func (o TLSOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.CAFile != "" {
+		pool := x509.NewCertPool()
+		for _, name := range filepath.SplitList(o.CAFile) {
+			pem, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading CA file failed")
+			}
+
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no CA certificates found in %s", name)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if o.SHA256Fingerprint != "" {
+		pinned := normalizeFingerprint(o.SHA256Fingerprint)
+
+		// the pin replaces the usual verification, since the point of it is
+		// to trust a certificate that wouldn't be trusted otherwise
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+			actual := formatFingerprint(sum[:])
+			if normalizeFingerprint(actual) != pinned {
+				return &FingerprintMismatchError{Algorithm: "SHA-256", Expected: o.SHA256Fingerprint, Actual: actual}
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// FingerprintMismatchError is returned when a server presents a certificate
+// with a different fingerprint than the one that was given for it.
+type FingerprintMismatchError struct {
+	// Algorithm is the hash algorithm of the fingerprint, e.g. "SHA-1".
+	Algorithm string
+
+	// Expected is the fingerprint that was given.
+	Expected string
+
+	// Actual is the fingerprint of the certificate the server presented.
+	Actual string
+}
+
+func (e *FingerprintMismatchError) Error() string {
+	return fmt.Sprintf("the server's certificate has %s fingerprint %s, but %s was expected", e.Algorithm, e.Actual, e.Expected)
+}
+
+// certificateSHA1Fingerprint connects to hostport and returns the SHA-1
+// fingerprint of the certificate it presents. The certificate is verified
+// using config first, so a fingerprint is only returned for a certificate
+// that would be trusted anyway.
+func certificateSHA1Fingerprint(hostport string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", hostport, config)
+	if err != nil {
+		return "", errors.Wrap(err, "connecting failed")
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum(conn.ConnectionState().PeerCertificates[0].Raw)
+	return formatFingerprint(sum[:]), nil
+}
+
+// checkSHA1Fingerprint returns a *FingerprintMismatchError if expected and
+// actual aren't the same fingerprint.
+func checkSHA1Fingerprint(expected string, actual string) error {
+	if normalizeFingerprint(expected) != normalizeFingerprint(actual) {
+		return &FingerprintMismatchError{Algorithm: "SHA-1", Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// formatFingerprint formats a hash as a series of :-separated uppercase
+// hexadecimal numbers, which is how vSphere formats fingerprints.
+func formatFingerprint(sum []byte) string {
+	formatted := make([]string, 0, len(sum))
+	for _, b := range sum {
+		formatted = append(formatted, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(formatted, ":")
+}
+
+// normalizeFingerprint makes fingerprints that only differ in case or
+// separators compare equal.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.TrimSpace(fingerprint))
+	fingerprint = strings.Replace(fingerprint, "-", "", -1)
+	return strings.Replace(fingerprint, ":", "", -1)
+}
@@ -0,0 +1,106 @@
+package vsphereimages
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewClientWithTLSUntrustedCertificate(t *testing.T) {
+	service, err := StartTLSService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	_, err = NewClientWithTLS(context.TODO(), service.URL(), TLSOptions{})
+	if err == nil {
+		t.Fatal("expected connecting with an untrusted certificate to fail")
+	}
+}
+
+func TestNewClientWithTLSCAFile(t *testing.T) {
+	service, err := StartTLSService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	caFile, err := service.Server.CertificateFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile)
+
+	ctx := context.TODO()
+	client, err := NewClientWithTLS(ctx, service.URL(), TLSOptions{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Logout(ctx)
+}
+
+func TestNewClientWithTLSSHA256Fingerprint(t *testing.T) {
+	service, err := StartTLSService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	sum := sha256.Sum256(service.Server.Certificate().Raw)
+	fingerprint := formatFingerprint(sum[:])
+
+	ctx := context.TODO()
+	client, err := NewClientWithTLS(ctx, service.URL(), TLSOptions{SHA256Fingerprint: strings.ToLower(fingerprint)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Logout(ctx)
+
+	wrong := strings.Repeat("00:", 31) + "00"
+	_, err = NewClientWithTLS(ctx, service.URL(), TLSOptions{SHA256Fingerprint: wrong})
+	if err == nil {
+		t.Fatal("expected connecting with the wrong fingerprint to fail")
+	}
+	if !strings.Contains(err.Error(), "but "+wrong+" was expected") {
+		t.Errorf("expected the error to say which fingerprint was expected, got %q", err)
+	}
+}
+
+func TestCopyImageVerifiesSHA1Fingerprint(t *testing.T) {
+	service, err := StartTLSService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{
+		VSphereEndpoint:           service.URL(),
+		VSphereInsecureSkipVerify: true,
+		VMPath:                    "/DC0/vm/DC0_H0_VM0",
+	}
+
+	destination := simulatorCopyDestination(service, "mismatched")
+	destination.VSphereInsecureSkipVerify = true
+	destination.VSphereSHA1Fingerprint = strings.Repeat("00:", 19) + "00"
+
+	err = CopyImage(ctx, source, destination, nil)
+	if _, ok := errors.Cause(err).(*FingerprintMismatchError); !ok {
+		t.Fatalf("expected a *FingerprintMismatchError, got %v", err)
+	}
+
+	sum := sha1.Sum(service.Server.Certificate().Raw)
+	destination = simulatorCopyDestination(service, "matched")
+	destination.VSphereInsecureSkipVerify = true
+	destination.VSphereSHA1Fingerprint = formatFingerprint(sum[:])
+
+	if err = CopyImage(ctx, source, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+}
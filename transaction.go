@@ -0,0 +1,120 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// RollbackError is returned when an operation fails after it has already made
+// changes. The changes are undone in reverse order, and RollbackError lists
+// which of them were and weren't undone.
+type RollbackError struct {
+	// Err is the error that made the operation fail.
+	Err error
+
+	// RolledBack describes the changes that were undone.
+	RolledBack []string
+
+	// NotRolledBack describes the changes that couldn't be undone, and why.
+	NotRolledBack []string
+}
+
+func (e *RollbackError) Error() string {
+	msg := e.Err.Error()
+	if len(e.RolledBack) > 0 {
+		msg += "; rolled back: " + strings.Join(e.RolledBack, ", ")
+	}
+	if len(e.NotRolledBack) > 0 {
+		msg += "; NOT rolled back: " + strings.Join(e.NotRolledBack, ", ")
+	}
+	return msg
+}
+
+// Cause returns the error that made the operation fail, so that
+// errors.Cause can see through a RollbackError.
+func (e *RollbackError) Cause() error {
+	return e.Err
+}
+
+// transaction records the changes made by a multi-step operation, so that
+// they can be undone if a later step fails.
+type transaction struct {
+	steps []transactionStep
+}
+
+type transactionStep struct {
+	description string
+	undo        func(context.Context) error
+}
+
+// done records that a change has been made, along with how to undo it.
+func (t *transaction) done(description string, undo func(context.Context) error) {
+	t.steps = append(t.steps, transactionStep{description: description, undo: undo})
+}
+
+// rollback undoes all of the recorded changes in reverse order. If no changes
+// had been made, err is returned as-is, otherwise a *RollbackError is
+// returned.
+//
+// Undoing a change may run vSphere tasks, but no progress is reported for
+// them, since the progress sinker has usually already seen the error that
+// caused the rollback. If ctx is done, such as when the operation was
+// cancelled, the changes are undone with a new context.
+func (t *transaction) rollback(ctx context.Context, err error) error {
+	if len(t.steps) == 0 {
+		return err
+	}
+
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	rollbackErr := &RollbackError{Err: err}
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if undoErr := step.undo(ctx); undoErr != nil {
+			rollbackErr.NotRolledBack = append(rollbackErr.NotRolledBack, fmt.Sprintf("%s (%v)", step.description, undoErr))
+		} else {
+			rollbackErr.RolledBack = append(rollbackErr.RolledBack, step.description)
+		}
+	}
+	t.steps = nil
+
+	return rollbackErr
+}
+
+// destroyImage destroys the VM at vmPath, if there is one.
+func (c *Client) destroyImage(ctx context.Context, vmPath string) error {
+	vm, err := c.findImageIfExists(ctx, vmPath)
+	if err != nil {
+		return errors.Wrap(err, "finding the VM failed")
+	}
+	if vm == nil {
+		return nil
+	}
+
+	return c.runTask(ctx, Action{Step: "destroying " + vmPath, Method: "Destroy_Task", Object: vmPath}, nil, func(s progress.Sinker) error {
+		task, err := vm.Destroy(ctx)
+		if err != nil {
+			return errors.Wrap(err, "creating task to destroy VM failed")
+		}
+
+		_, err = waitForTask(ctx, task, s)
+		return errors.Wrap(err, "destroying VM failed")
+	})
+}
+
+// findImageIfExists returns the VM at vmPath, or nil if there is no VM there.
+func (c *Client) findImageIfExists(ctx context.Context, vmPath string) (*object.VirtualMachine, error) {
+	vm, err := c.finder.VirtualMachine(ctx, vmPath)
+	if _, ok := err.(*find.NotFoundError); ok {
+		return nil, nil
+	}
+
+	return vm, err
+}
@@ -0,0 +1,75 @@
+package vsphereimages
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTransactionRollbackWithoutSteps(t *testing.T) {
+	var tx transaction
+	err := errors.New("failed")
+
+	if rollbackErr := tx.rollback(context.TODO(), err); rollbackErr != err {
+		t.Fatalf("expected the original error, got %v", rollbackErr)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	var tx transaction
+	var undone []string
+
+	tx.done("first", func(ctx context.Context) error {
+		undone = append(undone, "first")
+		return nil
+	})
+	tx.done("second", func(ctx context.Context) error {
+		undone = append(undone, "second")
+		return errors.New("could not undo")
+	})
+	tx.done("third", func(ctx context.Context) error {
+		undone = append(undone, "third")
+		return nil
+	})
+
+	cause := errors.New("fourth failed")
+	err := tx.rollback(context.TODO(), cause)
+
+	rollbackErr, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("expected a *RollbackError, got %T", err)
+	}
+	if errors.Cause(err) != cause {
+		t.Fatalf("expected the cause to be the original error, got %v", errors.Cause(err))
+	}
+	if !reflect.DeepEqual(undone, []string{"third", "second", "first"}) {
+		t.Fatalf("expected steps to be undone in reverse order, got %v", undone)
+	}
+	if !reflect.DeepEqual(rollbackErr.RolledBack, []string{"third", "first"}) {
+		t.Fatalf("unexpected rolled back steps %v", rollbackErr.RolledBack)
+	}
+	if !reflect.DeepEqual(rollbackErr.NotRolledBack, []string{"second (could not undo)"}) {
+		t.Fatalf("unexpected steps not rolled back %v", rollbackErr.NotRolledBack)
+	}
+}
+
+func TestTransactionRollbackAfterCancel(t *testing.T) {
+	var tx transaction
+	tx.done("first", func(ctx context.Context) error {
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := tx.rollback(ctx, ctx.Err())
+	rollbackErr, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("expected a *RollbackError, got %v", err)
+	}
+	if len(rollbackErr.NotRolledBack) > 0 {
+		t.Fatalf("expected the rollback to get a context that isn't done, got %v", rollbackErr)
+	}
+}
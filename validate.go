@@ -0,0 +1,133 @@
+package vsphereimages
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// CopyProblems is returned by ValidateCopy when a copy would fail. It lists
+// every problem that was found, rather than just the first one.
+type CopyProblems struct {
+	Problems []string
+}
+
+func (p *CopyProblems) Error() string {
+	return "copy would fail: " + strings.Join(p.Problems, "; ")
+}
+
+// ValidateCopy checks that CopyImage would be able to copy the source VM to
+// the destination, without changing anything. Every source and destination
+// object is looked up, the destination datastore is checked to have room for
+// the storage committed by the source VM, and any VM already using the name
+// in the destination folder is checked against destination.OnConflict.
+//
+// If any problems are found, a *CopyProblems listing all of them is returned.
+// Other errors, such as not being able to connect to either vCenter, are
+// returned as-is.
+func ValidateCopy(ctx context.Context, source ImageSource, destination ImageDestination) error {
+	srcClient, err := NewClientWithTLS(ctx, source.VSphereEndpoint, source.TLSOptions())
+	if err != nil {
+		return errors.Wrap(err, "creating source vSphere client failed")
+	}
+	defer srcClient.Logout(ctx)
+
+	destClient, err := NewClientWithTLS(ctx, destination.VSphereEndpoint, destination.TLSOptions())
+	if err != nil {
+		return errors.Wrap(err, "creating destination vSphere client failed")
+	}
+	defer destClient.Logout(ctx)
+
+	return srcClient.ValidateCopy(ctx, source.VMPath, destClient, destination)
+}
+
+// ValidateCopy checks that CopyImage would be able to copy the VM at vmPath to
+// the vCenter that destClient is connected to. See the ValidateCopy function
+// for details.
+func (c *Client) ValidateCopy(ctx context.Context, vmPath string, destClient *Client, destination ImageDestination) error {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	var committed int64
+	srcVM, err := c.finder.VirtualMachine(ctx, vmPath)
+	if err != nil {
+		problemf("finding the source VM failed: %v", err)
+	} else {
+		var mvm mo.VirtualMachine
+		err = srcVM.Properties(ctx, srcVM.Reference(), []string{"summary.storage"}, &mvm)
+		if err != nil {
+			return errors.Wrap(err, "getting the source VM's storage usage failed")
+		}
+		if mvm.Summary.Storage != nil {
+			committed = mvm.Summary.Storage.Committed
+		}
+	}
+
+	destFinder := destClient.finder
+
+	// If placement fails, the paths it would have chosen are left empty and
+	// aren't reported as missing on top of that.
+	checkPath := func(p string) bool { return true }
+	if destination.NeedsPlacement() {
+		placement, err := destClient.PlaceImage(ctx, destination.ClusterPath, destination.DatastorePattern)
+		if err != nil {
+			problemf("choosing where to put the destination VM failed: %v", err)
+			checkPath = func(p string) bool { return p != "" }
+		}
+		destination.FillPlacement(placement)
+	}
+
+	if _, err := destFinder.Folder(ctx, destination.FolderPath); err != nil {
+		problemf("finding the destination folder failed: %v", err)
+	} else if _, err := destClient.checkConflict(ctx, destination.FolderPath, destination.VMName, destination.OnConflict); err != nil {
+		problemf("%v", err)
+	}
+
+	if checkPath(destination.DatastorePath) {
+		datastore, err := destFinder.Datastore(ctx, destination.DatastorePath)
+		if err != nil {
+			problemf("finding the destination datastore failed: %v", err)
+		} else {
+			var mds mo.Datastore
+			if err = datastore.Properties(ctx, datastore.Reference(), []string{"summary"}, &mds); err != nil {
+				return errors.Wrap(err, "getting the destination datastore's free space failed")
+			}
+			if mds.Summary.FreeSpace < committed {
+				problemf("%v", &InsufficientSpaceError{DatastorePath: destination.DatastorePath, FreeSpace: mds.Summary.FreeSpace, Needed: committed})
+			}
+		}
+	}
+
+	if checkPath(destination.ResourcePoolPath) {
+		if _, err := destFinder.ResourcePool(ctx, destination.ResourcePoolPath); err != nil {
+			problemf("finding the destination resource pool failed: %v", err)
+		}
+	}
+
+	if checkPath(destination.HostPath) {
+		if _, err := destFinder.HostSystem(ctx, destination.HostPath); err != nil {
+			problemf("finding the destination host failed: %v", err)
+		}
+	}
+
+	if srcVM != nil {
+		if _, _, err := nicDeviceChanges(ctx, srcVM, destination.Networks, destination.NetworkPath, destination.NICPolicy, destFinder); err != nil {
+			problemf("connecting the source VM's NICs to destination networks failed: %v", err)
+		}
+	}
+
+	if _, _, err := destClient.credentials(); err != nil {
+		problemf("getting the destination credentials failed: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return &CopyProblems{Problems: problems}
+	}
+
+	return nil
+}
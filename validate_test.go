@@ -0,0 +1,95 @@
+package vsphereimages
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+)
+
+func simulatorCopyDestination(service *SimulatedService, vmName string) ImageDestination {
+	return ImageDestination{
+		VSphereEndpoint:        service.URL(),
+		VSphereSHA1Fingerprint: "00:11:22:33",
+		FolderPath:             "/DC0/vm",
+		DatastorePath:          "/DC0/datastore/LocalDS_0",
+		ResourcePoolPath:       "/DC0/host/DC0_C0/Resources",
+		HostPath:               "/DC0/host/DC0_C0/DC0_C0_H0",
+		NetworkPath:            "/DC0/network/VM Network",
+		VMName:                 vmName,
+	}
+}
+
+func TestValidateCopy(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	if err = ValidateCopy(ctx, source, simulatorCopyDestination(service, "copy")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateCopyReportsAllProblems(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/DC0_H0_VM0"}
+	destination := simulatorCopyDestination(service, "DC0_H0_VM1")
+	destination.DatastorePath = "/DC0/datastore/nonexistent"
+	destination.NetworkPath = "/DC0/network/nonexistent"
+
+	err = ValidateCopy(ctx, source, destination)
+	problems, ok := err.(*CopyProblems)
+	if !ok {
+		t.Fatalf("expected *CopyProblems, got %v", err)
+	}
+
+	expected := []string{
+		"/DC0/vm/DC0_H0_VM1 already exists",
+		"finding the destination datastore failed",
+		"connecting the source VM's NICs to destination networks failed: finding the network for ethernet-0 failed",
+	}
+	if len(problems.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems.Problems)
+	}
+	for i, problem := range problems.Problems {
+		if !strings.HasPrefix(problem, expected[i]) {
+			t.Errorf("expected problem %d to start with %q, got %q", i, expected[i], problem)
+		}
+	}
+}
+
+func TestValidateCopyInsufficientSpace(t *testing.T) {
+	service, err := StartService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	vm.Summary.Storage.Committed = 1 << 62
+
+	ctx := context.TODO()
+	source := ImageSource{VSphereEndpoint: service.URL(), VMPath: "/DC0/vm/" + vm.Name}
+	err = ValidateCopy(ctx, source, simulatorCopyDestination(service, "copied"))
+	problems, ok := err.(*CopyProblems)
+	if !ok || len(problems.Problems) != 1 || !strings.Contains(problems.Problems[0], "bytes free") {
+		t.Fatalf("expected the destination datastore to be reported as too small, got %v", err)
+	}
+
+	// the committed storage includes swap and logs, and a thin-provisioned
+	// copy can use less, so it's left to vSphere to fail the copy
+	if err = CopyImage(ctx, source, simulatorCopyDestination(service, "copied"), nil); err != nil {
+		t.Fatal(err)
+	}
+}